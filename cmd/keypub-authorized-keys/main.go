@@ -0,0 +1,121 @@
+// keypub-authorized-keys is an AuthorizedKeysCommand for sshd that serves the
+// keys registered in keypub for the email mapped to the login user.
+//
+// sshd_config:
+//
+//	AuthorizedKeysCommand /usr/local/bin/keypub-authorized-keys -config /etc/keypub/authorized_keys.json %u %f
+//	AuthorizedKeysCommandUser nobody
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const usageText = `Usage: keypub-authorized-keys [options] <user> [fingerprint]
+
+Prints the keys registered in keypub for the email(s) mapped to <user>, in
+authorized_keys format. If a fingerprint is given (sshd's %f), only the
+matching key is printed.
+
+Options:
+  -config string
+        path to config file (default "/etc/keypub/authorized_keys.json")`
+
+// Config holds the helper configuration. Exactly one of DatabasePath and
+// Server.Address must be set.
+type Config struct {
+	MappingPath  string `json:"mapping_path"`  // File mapping login users to emails
+	DatabasePath string `json:"database_path"` // Local read-only copy of the keypub database
+	Server       struct {
+		Address      string        `json:"address"`       // keypub server, e.g. keypub.sh:22
+		IdentityPath string        `json:"identity_path"` // Key registered in keypub and allowed by the mapped users
+		HostKey      string        `json:"host_key"`      // Pinned server host key in authorized_keys format
+		Timeout      time.Duration `json:"timeout"`
+	} `json:"server"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+
+	cfg := &Config{}
+	cfg.MappingPath = "/etc/keypub/users"
+	cfg.Server.Timeout = 10 * time.Second
+	if err := json.Unmarshal(file, cfg); err != nil {
+		return nil, fmt.Errorf("error parsing config file: %v", err)
+	}
+
+	if (cfg.DatabasePath == "") == (cfg.Server.Address == "") {
+		return nil, fmt.Errorf("exactly one of database_path and server.address must be set")
+	}
+
+	return cfg, nil
+}
+
+func main() {
+	// sshd logs our stderr, keep it terse
+	log.SetFlags(0)
+	log.SetPrefix("keypub-authorized-keys: ")
+
+	configPath := flag.String("config", "/etc/keypub/authorized_keys.json", "path to config file")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\n", usageText)
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	user := flag.Arg(0)
+	fingerprint := flag.Arg(1)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	emails, err := lookupUser(cfg.MappingPath, user)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(emails) == 0 {
+		// Unknown users simply have no keys
+		return
+	}
+
+	var source KeySource
+	if cfg.DatabasePath != "" {
+		source, err = NewDBKeySource(cfg.DatabasePath)
+	} else {
+		source, err = NewServerKeySource(cfg)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer source.Close()
+
+	for _, email := range emails {
+		keys, err := source.Keys(email)
+		if err != nil {
+			// Keep serving the other emails, sshd only needs one match
+			log.Printf("cannot fetch keys for %s: %v", email, err)
+			continue
+		}
+		for _, key := range keys {
+			if fingerprint != "" && key.Fingerprint != fingerprint {
+				continue
+			}
+			fmt.Println(key.Line)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"keypub/internal/mail"
+)
+
+// lookupUser returns the emails mapped to the given login user.
+//
+// The mapping file has one user per line followed by one or more emails:
+//
+//	# login  email...
+//	alice    alice@corp.com
+//	deploy   alice@corp.com bob@corp.com
+func lookupUser(path, user string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open mapping file: %w", err)
+	}
+	defer file.Close()
+
+	var emails []string
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected a user followed by at least one email", path, lineNumber)
+		}
+		if fields[0] != user {
+			continue
+		}
+		for _, email := range fields[1:] {
+			if err := mail.ValidateEmail(email); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid email %q: %w", path, lineNumber, email, err)
+			}
+			emails = append(emails, email)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read mapping file: %w", err)
+	}
+
+	return emails, nil
+}
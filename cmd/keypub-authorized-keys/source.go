@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"keypub/internal/db/.gen/table"
+	"keypub/internal/sshclient"
+
+	. "github.com/go-jet/jet/v2/sqlite"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Key is a single authorized_keys line and the fingerprint of its key
+type Key struct {
+	Line        string
+	Fingerprint string
+}
+
+// KeySource resolves an email to its verified keys
+type KeySource interface {
+	Keys(email string) ([]Key, error)
+	Close() error
+}
+
+// parseKeys parses authorized_keys lines, skipping anything that is not a key
+func parseKeys(lines []string) []Key {
+	var keys []Key
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		publicKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			log.Printf("skipping invalid key line: %v", err)
+			continue
+		}
+		keys = append(keys, Key{
+			Line:        line,
+			Fingerprint: gossh.FingerprintSHA256(publicKey),
+		})
+	}
+	return keys
+}
+
+// DBKeySource reads keys from a local copy of the keypub database
+type DBKeySource struct {
+	db *sql.DB
+}
+
+func NewDBKeySource(path string) (KeySource, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro&_busy_timeout=5000", path))
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connecting to database: %w", err)
+	}
+	return &DBKeySource{db: db}, nil
+}
+
+// Keys returns the keys of the email, leaving out banned keys and nothing
+// at all for a banned email, as the server does
+func (s *DBKeySource) Keys(email string) ([]Key, error) {
+	banned := SELECT(table.Bans.Target).FROM(table.Bans)
+
+	var publicKeys []string
+	err := SELECT(table.SSHKeys.PublicKey).
+		FROM(table.SSHKeys).
+		WHERE(
+			AND(
+				table.SSHKeys.Email.EQ(String(email)),
+				table.SSHKeys.PublicKey.IS_NOT_NULL(),
+				table.SSHKeys.Email.NOT_IN(banned),
+				table.SSHKeys.Fingerprint.NOT_IN(banned),
+			),
+		).
+		ORDER_BY(table.SSHKeys.CreatedAt.ASC()).
+		Query(s.db, &publicKeys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query keys: %w", err)
+	}
+
+	// Match the server's output, which comments each key with its email
+	lines := make([]string, len(publicKeys))
+	for i, publicKey := range publicKeys {
+		lines[i] = fmt.Sprintf("%s %s", publicKey, email)
+	}
+	return parseKeys(lines), nil
+}
+
+func (s *DBKeySource) Close() error {
+	return s.db.Close()
+}
+
+// ServerKeySource asks the keypub server with `get keys <email>`. The
+// configured identity must be registered and allowed by each mapped email.
+type ServerKeySource struct {
+	client *sshclient.Client
+}
+
+func NewServerKeySource(cfg *Config) (KeySource, error) {
+	client, err := sshclient.Dial(sshclient.Config{
+		Address:      cfg.Server.Address,
+		IdentityPath: cfg.Server.IdentityPath,
+		HostKey:      cfg.Server.HostKey,
+		Timeout:      cfg.Server.Timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ServerKeySource{client: client}, nil
+}
+
+func (s *ServerKeySource) Keys(email string) ([]Key, error) {
+	output, err := s.client.Run("get", "keys", email)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeys(strings.Split(output, "\n")), nil
+}
+
+func (s *ServerKeySource) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,290 @@
+// keypub-verify audits the keypub transparency log. Each run fetches the
+// current signed tree head, checks it against the pinned server host key and
+// proves it consistent with the head seen on the previous run, so that a
+// server rewriting or forking its history is detected.
+//
+// Exit status is 0 when the log is consistent, 1 when the server presented
+// an inconsistent log (alert!), and 2 when the check could not be performed.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"keypub/internal/sshclient"
+	"keypub/internal/translog"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	exitInconsistent = 1
+	exitError        = 2
+)
+
+const usageText = `Usage: keypub-verify [options]
+
+Verifies that the keypub transparency log only ever grows, and remembers the
+last verified tree head in a state file. Meant to be run from cron.
+
+Options:
+  -server string
+        keypub server address (default "keypub.sh:22")
+  -host-key string
+        file with the pinned server host key, in authorized_keys or known_hosts format (required)
+  -identity string
+        private key used to connect (default "~/.ssh/id_ed25519")
+  -state string
+        state file (default "~/.local/state/keypub-verify/state.json")
+  -email string
+        also list the log entries for this email added since the previous
+        run; the first run only records the current head
+  -timeout duration
+        connection timeout (default 30s)
+
+Exit status:
+  0  the log is consistent with the last verified head
+  1  the server presented an inconsistent log (fork, rollback or bad signature)
+  2  the check could not be performed`
+
+// inconsistency is evidence that the server misbehaved, as opposed to an
+// operational failure such as a network error
+type inconsistency struct {
+	msg string
+}
+
+func (e *inconsistency) Error() string {
+	return e.msg
+}
+
+func inconsistent(format string, args ...any) error {
+	return &inconsistency{msg: fmt.Sprintf(format, args...)}
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("keypub-verify: ")
+
+	home, _ := os.UserHomeDir()
+	server := flag.String("server", "keypub.sh:22", "keypub server address")
+	hostKeyPath := flag.String("host-key", "", "file with the pinned server host key")
+	identity := flag.String("identity", filepath.Join(home, ".ssh", "id_ed25519"), "private key used to connect")
+	statePath := flag.String("state", filepath.Join(home, ".local", "state", "keypub-verify", "state.json"), "state file")
+	email := flag.String("email", "", "also list log entries for this email")
+	timeout := flag.Duration("timeout", 30*time.Second, "connection timeout")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\n", usageText)
+	}
+	flag.Parse()
+
+	if *hostKeyPath == "" || flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(exitError)
+	}
+
+	hostKey, err := loadHostKey(*hostKeyPath)
+	if err != nil {
+		log.Print(err)
+		os.Exit(exitError)
+	}
+
+	client, err := sshclient.Dial(sshclient.Config{
+		Address:      *server,
+		IdentityPath: *identity,
+		HostKey:      string(gossh.MarshalAuthorizedKey(hostKey)),
+		Timeout:      *timeout,
+	})
+	if err != nil {
+		log.Print(err)
+		os.Exit(exitError)
+	}
+	defer client.Close()
+
+	err = verify(client, hostKey, *server, *statePath, *email)
+	var bad *inconsistency
+	if errors.As(err, &bad) {
+		log.Printf("INCONSISTENT LOG: %s", bad)
+		os.Exit(exitInconsistent)
+	}
+	if err != nil {
+		log.Print(err)
+		os.Exit(exitError)
+	}
+}
+
+// loadHostKey reads the pinned host key from an authorized_keys or known_hosts line
+func loadHostKey(path string) (gossh.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read host key: %w", err)
+	}
+	if key, _, _, _, err := gossh.ParseAuthorizedKey(data); err == nil {
+		return key, nil
+	}
+	_, _, key, _, _, err := gossh.ParseKnownHosts(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse host key: %w", err)
+	}
+	return key, nil
+}
+
+func verify(client *sshclient.Client, hostKey gossh.PublicKey, server, statePath, email string) error {
+	output, err := client.Run("log", "head")
+	if err != nil {
+		return fmt.Errorf("cannot fetch tree head: %w", err)
+	}
+	head, err := translog.ParseSignedTreeHead(output)
+	if err != nil {
+		return inconsistent("malformed tree head: %v", err)
+	}
+	if err := head.Verify(hostKey); err != nil {
+		return inconsistent("%v", err)
+	}
+
+	state, last, err := loadState(statePath)
+	if err != nil {
+		return err
+	}
+	if state != nil && state.Server != server {
+		return fmt.Errorf("state file %s belongs to server %s", statePath, state.Server)
+	}
+
+	if last == nil {
+		log.Printf("no previous state, trusting tree head of size %d on first use", head.Size)
+		return saveState(statePath, &State{Server: server, Head: head.String(), Listed: &head.Size})
+	}
+
+	if err := checkConsistency(client, last, head); err != nil {
+		return err
+	}
+	log.Printf("log grew consistently from size %d to %d", last.Size, head.Size)
+
+	// Every entry costs a command, so a run may be rate limited before it has
+	// listed them all. The head is verified by then, and the entries listed
+	// so far are saved so the next run does not start over.
+	listed := last.Size
+	if state.Listed != nil {
+		listed = *state.Listed
+	}
+	var listErr error
+	if email != "" {
+		listed, listErr = listEntries(client, hostKey, head, email, listed)
+		var bad *inconsistency
+		if errors.As(listErr, &bad) {
+			return listErr
+		}
+	} else {
+		listed = head.Size
+	}
+
+	if err := saveState(statePath, &State{Server: server, Head: head.String(), Listed: &listed}); err != nil {
+		return err
+	}
+	return listErr
+}
+
+// checkConsistency proves that head extends last. Any failure means the
+// server signed two incompatible views of the log, and both heads are printed
+// as evidence.
+func checkConsistency(client *sshclient.Client, last, head *translog.SignedTreeHead) error {
+	evidence := func(format string, args ...any) error {
+		return inconsistent("%s\nprevious head:\n%s\ncurrent head:\n%s",
+			fmt.Sprintf(format, args...), last, head)
+	}
+
+	if head.Timestamp < last.Timestamp {
+		return evidence("tree head timestamp went backwards")
+	}
+	if head.Size < last.Size {
+		return evidence("log shrank from size %d to %d (rollback)", last.Size, head.Size)
+	}
+	if head.Size == last.Size {
+		if !bytes.Equal(head.RootHash, last.RootHash) {
+			return evidence("different root hashes for size %d (fork)", head.Size)
+		}
+		return nil
+	}
+
+	output, err := client.Run("log", "consistency",
+		strconv.FormatUint(last.Size, 10), strconv.FormatUint(head.Size, 10))
+	if err != nil {
+		return fmt.Errorf("cannot fetch consistency proof: %w", err)
+	}
+	proof, err := translog.ParseConsistencyProof(output)
+	if err != nil {
+		return evidence("malformed consistency proof: %v", err)
+	}
+	if proof.OldSize != last.Size || proof.NewSize != head.Size {
+		return evidence("consistency proof is for sizes %d and %d", proof.OldSize, proof.NewSize)
+	}
+	if err := proof.Verify(last.RootHash, head.RootHash); err != nil {
+		return evidence("consistency proof from size %d to %d: %v (fork)", last.Size, head.Size, err)
+	}
+
+	return nil
+}
+
+// listEntries prints the entries from index from up to the verified head that
+// mention the email, and returns the index of the first entry it did not
+// check. Each proof comes with the server's current head, which must be the
+// verified head or consistent with it.
+func listEntries(client *sshclient.Client, hostKey gossh.PublicKey, head *translog.SignedTreeHead, email string, from uint64) (uint64, error) {
+	emailHash := translog.HashEmail(email)
+	consistentHeads := map[string]bool{fmt.Sprintf("%x", head.RootHash): true}
+
+	for index := from; index < head.Size; index++ {
+		output, err := client.Run("log", "proof", strconv.FormatUint(index, 10))
+		if err != nil {
+			return index, fmt.Errorf("cannot fetch entry %d: %w", index, err)
+		}
+		proof, err := translog.ParseInclusionProof(output)
+		if err != nil {
+			return index, inconsistent("malformed inclusion proof for entry %d: %v", index, err)
+		}
+		if err := proof.Head.Verify(hostKey); err != nil {
+			return index, inconsistent("entry %d: %v", index, err)
+		}
+		if proof.LeafIndex != index {
+			return index, inconsistent("asked for entry %d, got entry %d", index, proof.LeafIndex)
+		}
+		if err := proof.Verify(); err != nil {
+			return index, inconsistent("inclusion proof for entry %d: %v", index, err)
+		}
+		if root := fmt.Sprintf("%x", proof.Head.RootHash); !consistentHeads[root] {
+			if err := checkConsistency(client, head, &proof.Head); err != nil {
+				return index, err
+			}
+			consistentHeads[root] = true
+		}
+
+		var entry translog.Entry
+		if err := json.Unmarshal([]byte(proof.LeafData), &entry); err != nil {
+			return index, inconsistent("malformed entry %d: %v", index, err)
+		}
+		if entry.EmailHash != emailHash && entry.GranteeHash != emailHash {
+			continue
+		}
+
+		fields := []string{
+			fmt.Sprintf("#%d", index),
+			time.Unix(entry.Timestamp, 0).UTC().Format(time.RFC3339),
+			entry.Op,
+			entry.Fingerprint,
+		}
+		if entry.GranteeHash == emailHash {
+			fields = append(fields, "(as grantee)")
+		}
+		fmt.Println(strings.Join(fields, " "))
+	}
+
+	return head.Size, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"keypub/internal/translog"
+)
+
+// State is the last tree head that was verified, kept between runs
+type State struct {
+	Server string `json:"server"`
+	Head   string `json:"head"` // Signed tree head as returned by `log head`
+
+	// Entries before Listed have been checked for -email. It is behind Head
+	// when a run stopped early, such as when rate limited, and the next run
+	// goes on from there. Older state files lack it, for the size of Head.
+	Listed *uint64 `json:"listed,omitempty"`
+}
+
+// loadState returns the saved state, or nil if there is none yet
+func loadState(path string) (*State, *translog.SignedTreeHead, error) {
+	file, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading state file: %v", err)
+	}
+
+	state := &State{}
+	if err := json.Unmarshal(file, state); err != nil {
+		return nil, nil, fmt.Errorf("error parsing state file: %v", err)
+	}
+	head, err := translog.ParseSignedTreeHead(state.Head)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing saved tree head: %v", err)
+	}
+
+	return state, head, nil
+}
+
+// saveState atomically replaces the state file
+func saveState(path string, state *State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding state: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating state directory: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".keypub-verify-*")
+	if err != nil {
+		return fmt.Errorf("error creating state file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error replacing state file: %v", err)
+	}
+
+	return nil
+}
@@ -6,15 +6,20 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"slices"
 	"strings"
 	"time"
 
 	cmd "keypub/internal/command"
 	"keypub/internal/db/.gen/table"
+	"keypub/internal/i18n"
 	"keypub/internal/mail"
+	"keypub/internal/translog"
 
+	"github.com/gliderlabs/ssh"
 	. "github.com/go-jet/jet/v2/sqlite"
 	_ "github.com/mattn/go-sqlite3"
+	gossh "golang.org/x/crypto/ssh"
 )
 
 func registerCommandAccount(registry *cmd.CommandRegistry) *cmd.CommandRegistry {
@@ -22,20 +27,23 @@ func registerCommandAccount(registry *cmd.CommandRegistry) *cmd.CommandRegistry
 	registry.Register(cmd.Command{
 		Name:        "whoami",
 		Usage:       "whoami",
-		Description: "Show your fingerprint, registered email, registration date, and list of users allowed to see your email.",
+		Description: "Show your fingerprint, registered emails, registration dates, and list of users allowed to see each email.",
 		Category:    "Account",
-		Handler: func(ctx *cmd.CommandContext) (info string, err error) {
-			return handleWhoami(ctx.DB, ctx.Fingerprint)
+		Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+			return handleWhoami(ctx.DB, ctx.Fingerprint, ctx.Caller.Emails, ctx.Lang())
 		},
 	})
 
 	registry.Register(cmd.Command{
 		Name:        "register",
 		Usage:       "register <email>",
-		Description: "Register your SSH key with the given email address. You will receive a confirmation code via email.",
+		Description: "Register your SSH key with the given email address. You will receive a confirmation code via email. A key can have several emails, the first one is primary.",
 		Category:    "Account",
-		Handler: func(ctx *cmd.CommandContext) (info string, err error) {
-			return handleRegister(ctx.DB, ctx.MailSender, ctx.Args[1], ctx.Fingerprint)
+		// Sends a real email, so it gets its own and much tighter budget
+		Cost:   100,
+		Bucket: "mail",
+		Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+			return handleRegister(ctx.DB, ctx.MailSender, ctx.Params.String("email"), ctx.Fingerprint, ctx.Lang())
 		},
 	})
 	registry.Register(cmd.Command{
@@ -43,28 +51,81 @@ func registerCommandAccount(registry *cmd.CommandRegistry) *cmd.CommandRegistry
 		Usage:       "confirm <code>",
 		Description: "Confirm your email address using the code you received. This completes your registration.",
 		Category:    "Account",
-		Handler: func(ctx *cmd.CommandContext) (info string, err error) {
-			return handleConfirm(ctx.DB, ctx.Fingerprint, ctx.Args[1])
+		Cost:        10, // Slows down guessing codes
+		Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+			return handleConfirm(ctx.DB, ctx.PublicKey, ctx.Params.String("code"))
 		},
 	})
 	registry.Register(cmd.Command{
 		Name:        "unregister",
-		Usage:       "unregister",
-		Description: "Remove your registration and all associated permissions. This cannot be undone.",
+		Usage:       "unregister <email>",
+		Description: "Remove the given email from your key, with its permissions if no other key uses it. Removing the last email removes your registration. This cannot be undone.",
 		Category:    "Account",
-		Handler: func(ctx *cmd.CommandContext) (info string, err error) {
-			return handleUnregister(ctx.DB, ctx.Fingerprint)
+		Middleware:  []cmd.Middleware{cmd.RequireRegistered},
+		Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+			return handleUnregister(ctx.DB, ctx.Fingerprint, ctx.Caller.Emails, ctx.Params.String("email"))
+		},
+	})
+	registry.Register(cmd.Command{
+		Name:        "set",
+		Usage:       "set <subcommand>",
+		Description: "Change your account settings",
+		Category:    "Account",
+		Subcommands: map[string]cmd.Command{
+			"primary": {
+				Name:        "primary",
+				Usage:       "set primary <email>",
+				Description: "Make the given email, already registered with your key, your primary email",
+				Middleware:  []cmd.Middleware{cmd.RequireRegistered},
+				Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+					return handleSetPrimary(ctx.DB, ctx.Fingerprint, ctx.Caller.Emails, ctx.Params.String("email"))
+				},
+			},
+			"lang": {
+				Name:        "lang",
+				Usage:       "set lang <code>",
+				Description: "Choose the language of messages and confirmation mails, e.g. en or de. Works before registering too.",
+				Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+					return handleSetLang(ctx.DB, ctx.Caller, ctx.Params.String("code"))
+				},
+			},
 		},
 	})
 	return registry
 }
 
-func handleWhoami(db *sql.DB, fingerprint string) (string, error) {
-	// TODO: handle cases with more than 1 mail per fingerprint
+// whoamiData is the JSON output of whoami
+type whoamiData struct {
+	Fingerprint string        `json:"fingerprint"`
+	Registered  bool          `json:"registered"`
+	Emails      []whoamiEmail `json:"emails"`
+}
+
+type whoamiEmail struct {
+	Email        string        `json:"email"`
+	Primary      bool          `json:"primary"`
+	Keys         []whoamiKey   `json:"keys"`
+	AllowedUsers []whoamiGrant `json:"allowed_users"`
+}
+
+type whoamiKey struct {
+	Fingerprint  string `json:"fingerprint"`
+	Current      bool   `json:"current"`
+	RegisteredAt string `json:"registered_at"`
+}
+
+type whoamiGrant struct {
+	Email     string `json:"email"`
+	GrantedAt string `json:"granted_at"`
+}
+
+// handleWhoami describes the caller's key, whose emails are given primary
+// first, or tells unregistered callers their fingerprint
+func handleWhoami(db *sql.DB, fingerprint string, emails []string, lang string) (*cmd.Result, error) {
 	// Start transaction
 	tx, err := db.Begin()
 	if err != nil {
-		return "", fmt.Errorf("failed to begin transaction: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer func() {
 		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
@@ -72,104 +133,131 @@ func handleWhoami(db *sql.DB, fingerprint string) (string, error) {
 		}
 	}()
 
-	// First get the email for the current fingerprint
-	var userEmails []string
-	err = SELECT(table.SSHKeys.Email).
-		FROM(table.SSHKeys).
-		WHERE(table.SSHKeys.Fingerprint.EQ(String(fingerprint))).
-		Query(tx, &userEmails)
-
+	var result strings.Builder
+	data, err := describeKey(tx, fingerprint, emails, lang, &result)
 	if err != nil {
-		return "", fmt.Errorf("failed to query user email: %w", err)
+		return nil, err
 	}
-	if len(userEmails) == 0 {
-		return fmt.Sprintf("You are not registered. Your fingerprint is %s", fingerprint), nil
-	}
-	if len(userEmails) > 1 {
-		return "", fmt.Errorf("multiple emails found for fingerprint: %s", fingerprint)
+	if !data.Registered {
+		return cmd.Message("You are not registered. Your fingerprint is %s", fingerprint).WithData(data), nil
 	}
-	userEmail := userEmails[0]
 
-	// Get all fingerprints and their registration times for this email
-	type KeyInfo struct {
-		Fingerprint string
-		CreatedAt   int32
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
-	var keyInfos []KeyInfo
-	err = SELECT(
-		table.SSHKeys.Fingerprint.AS("key_info.fingerprint"),
-		table.SSHKeys.CreatedAt.AS("key_info.created_at"),
-	).FROM(
-		table.SSHKeys,
-	).WHERE(
-		table.SSHKeys.Email.EQ(String(userEmail)),
-	).ORDER_BY(
-		table.SSHKeys.CreatedAt.ASC(),
-	).Query(tx, &keyInfos)
 
-	if err != nil {
-		return "", fmt.Errorf("failed to query key info: %w", err)
-	}
+	return &cmd.Result{Text: strings.TrimSuffix(result.String(), "\n"), Data: data}, nil
+}
 
-	// Get allowed users and their grant times
-	var allowedUsers []struct {
-		Email     string
-		CreatedAt int32
+// describeKey writes the emails of a fingerprint, given primary first, with
+// their keys and allowed users in lang, as shown by whoami. It writes nothing
+// for unregistered fingerprints.
+func describeKey(tx *sql.Tx, fingerprint string, userEmails []string, lang string, result *strings.Builder) (whoamiData, error) {
+	data := whoamiData{Fingerprint: fingerprint, Emails: []whoamiEmail{}}
+	if len(userEmails) == 0 {
+		return data, nil
 	}
-	err = SELECT(
-		table.EmailPermissions.GranteeEmail.AS("email"),
-		table.EmailPermissions.CreatedAt.AS("created_at"),
-	).FROM(
-		table.EmailPermissions,
-	).WHERE(
-		table.EmailPermissions.GranterEmail.EQ(String(userEmail)),
-	).ORDER_BY(
-		table.EmailPermissions.CreatedAt.ASC(),
-	).Query(tx, &allowedUsers)
 
-	if err != nil {
-		return "", fmt.Errorf("failed to query allowed users: %w", err)
-	}
+	// Format the output
+	result.WriteString(i18n.Sprintf(lang, "Fingerprint: %s", fingerprint) + "\n")
+	data.Registered = true
+
+	for i, userEmail := range userEmails {
+		// Get all fingerprints and their registration times for this email
+		type KeyInfo struct {
+			Fingerprint string
+			CreatedAt   int32
+		}
+		var keyInfos []KeyInfo
+		err := SELECT(
+			table.SSHKeys.Fingerprint.AS("key_info.fingerprint"),
+			table.SSHKeys.CreatedAt.AS("key_info.created_at"),
+		).FROM(
+			table.SSHKeys,
+		).WHERE(
+			table.SSHKeys.Email.EQ(String(userEmail)),
+		).ORDER_BY(
+			table.SSHKeys.CreatedAt.ASC(),
+		).Query(tx, &keyInfos)
 
-	// Commit transaction
-	if err = tx.Commit(); err != nil {
-		return "", fmt.Errorf("failed to commit transaction: %w", err)
-	}
+		if err != nil {
+			return data, fmt.Errorf("failed to query key info: %w", err)
+		}
 
-	// Format the output
-	var result strings.Builder
+		// Get allowed users and their grant times
+		var allowedUsers []struct {
+			Email     string
+			CreatedAt int32
+		}
+		err = SELECT(
+			table.EmailPermissions.GranteeEmail.AS("email"),
+			table.EmailPermissions.CreatedAt.AS("created_at"),
+		).FROM(
+			table.EmailPermissions,
+		).WHERE(
+			table.EmailPermissions.GranterEmail.EQ(String(userEmail)),
+		).ORDER_BY(
+			table.EmailPermissions.CreatedAt.ASC(),
+		).Query(tx, &allowedUsers)
 
-	// Format user info
-	result.WriteString(fmt.Sprintf("Email: %s\n\n", userEmail))
-	result.WriteString("Registered Keys:\n")
+		if err != nil {
+			return data, fmt.Errorf("failed to query allowed users: %w", err)
+		}
 
-	for _, key := range keyInfos {
-		createdTime := time.Unix(int64(key.CreatedAt), 0)
-		if key.Fingerprint == fingerprint {
-			result.WriteString(fmt.Sprintf("* %s (current) - registered: %s\n",
-				key.Fingerprint,
-				createdTime.Format(time.RFC3339)))
+		emailData := whoamiEmail{
+			Email:        userEmail,
+			Primary:      i == 0,
+			Keys:         []whoamiKey{},
+			AllowedUsers: []whoamiGrant{},
+		}
+
+		// Format user info, the primary email comes first
+		if i == 0 {
+			result.WriteString("\n" + i18n.Sprintf(lang, "Email: %s (primary)", userEmail) + "\n\n")
 		} else {
-			result.WriteString(fmt.Sprintf("  %s - registered: %s\n",
-				key.Fingerprint,
-				createdTime.Format(time.RFC3339)))
+			result.WriteString("\n" + i18n.Sprintf(lang, "Email: %s", userEmail) + "\n\n")
+		}
+		result.WriteString(i18n.T(lang, "Registered Keys:") + "\n")
+
+		for _, key := range keyInfos {
+			createdTime := time.Unix(int64(key.CreatedAt), 0)
+			emailData.Keys = append(emailData.Keys, whoamiKey{
+				Fingerprint:  key.Fingerprint,
+				Current:      key.Fingerprint == fingerprint,
+				RegisteredAt: createdTime.Format(time.RFC3339),
+			})
+			if key.Fingerprint == fingerprint {
+				result.WriteString("* " + i18n.Sprintf(lang, "%s (current) - registered: %s",
+					key.Fingerprint,
+					createdTime.Format(time.RFC3339)) + "\n")
+			} else {
+				result.WriteString("  " + i18n.Sprintf(lang, "%s - registered: %s",
+					key.Fingerprint,
+					createdTime.Format(time.RFC3339)) + "\n")
+			}
 		}
-	}
 
-	// Format allowed users
-	if len(allowedUsers) == 0 {
-		result.WriteString("\nNo users are allowed to see your email.")
-	} else {
-		result.WriteString("\nAllowed users:\n")
-		for _, user := range allowedUsers {
-			grantTime := time.Unix(int64(user.CreatedAt), 0)
-			result.WriteString(fmt.Sprintf("- %s (granted: %s)\n",
-				user.Email,
-				grantTime.Format(time.RFC3339)))
+		// Format allowed users
+		if len(allowedUsers) == 0 {
+			result.WriteString("\n" + i18n.T(lang, "No users are allowed to see this email.") + "\n")
+		} else {
+			result.WriteString("\n" + i18n.T(lang, "Allowed users:") + "\n")
+			for _, user := range allowedUsers {
+				grantTime := time.Unix(int64(user.CreatedAt), 0)
+				emailData.AllowedUsers = append(emailData.AllowedUsers, whoamiGrant{
+					Email:     user.Email,
+					GrantedAt: grantTime.Format(time.RFC3339),
+				})
+				result.WriteString("- " + i18n.Sprintf(lang, "%s (granted: %s)",
+					user.Email,
+					grantTime.Format(time.RFC3339)) + "\n")
+			}
 		}
+		data.Emails = append(data.Emails, emailData)
 	}
 
-	return result.String(), nil
+	return data, nil
 }
 
 func generateVerificationCode() string {
@@ -191,16 +279,15 @@ func generateVerificationCode() string {
 	return string(result)
 }
 
-func handleRegister(db *sql.DB, mail_sender mail.MailSender, to_email string, fingerprint string) (info string, err error) {
-	// TODO: allow more than 1 mail per fingerprint
-	// Start transaction
-	err = mail.ValidateEmail(to_email)
+func handleRegister(db *sql.DB, mail_sender mail.MailSender, to_email string, fingerprint string, lang string) (*cmd.Result, error) {
+	err := mail.ValidateEmail(to_email)
 	if err != nil {
-		return "", fmt.Errorf("mail address fails validation")
+		return nil, cmd.Errorf(cmd.CodeInvalidArgument, "mail address fails validation")
 	}
+	// Start transaction
 	tx, err := db.Begin()
 	if err != nil {
-		return "", fmt.Errorf("failed to begin transaction: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer func() {
 		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
@@ -208,6 +295,14 @@ func handleRegister(db *sql.DB, mail_sender mail.MailSender, to_email string, fi
 		}
 	}()
 
+	banned, err := isBanned(tx, to_email)
+	if err != nil {
+		return nil, err
+	}
+	if banned {
+		return nil, cmd.Errorf(cmd.CodePermissionDenied, "email is banned")
+	}
+
 	// Check if email and fingerprint combination exists using COUNT
 	stmt := SELECT(
 		COUNT(table.SSHKeys.Fingerprint),
@@ -223,19 +318,20 @@ func handleRegister(db *sql.DB, mail_sender mail.MailSender, to_email string, fi
 	var counts []int64
 	err = stmt.Query(tx, &counts)
 	if err != nil {
-		return "", fmt.Errorf("failed to query existing keys: %w", err)
+		return nil, fmt.Errorf("failed to query existing keys: %w", err)
 	}
 	if len(counts) != 1 {
-		return "", fmt.Errorf("could not count email and fingerprint pairs in db. len(count)=%d", len(counts))
+		return nil, fmt.Errorf("could not count email and fingerprint pairs in db. len(count)=%d", len(counts))
 	}
 
 	count := counts[0]
 	if count > 0 {
-		return "", fmt.Errorf("email and fingerprint combination already registered")
+		return nil, cmd.Errorf(cmd.CodeConflict, "email and fingerprint combination already registered")
 	}
 
 	////////////////////////////
-	// Check if email and fingerprint combination exists using COUNT
+	// Only one pending verification per fingerprint, so a key cannot flood
+	// many addresses with confirmation mails
 	stmt = SELECT(
 		COUNT(table.VerificationCodes.Fingerprint),
 	).FROM(
@@ -247,15 +343,15 @@ func handleRegister(db *sql.DB, mail_sender mail.MailSender, to_email string, fi
 	counts = nil
 	err = stmt.Query(tx, &counts)
 	if err != nil {
-		return "", fmt.Errorf("failed to query existing keys in verification codes table: %w", err)
+		return nil, fmt.Errorf("failed to query existing keys in verification codes table: %w", err)
 	}
 	if len(counts) != 1 {
-		return "", fmt.Errorf("could not count email and fingerprint pairs in db (verification codes table). len(count)=%d", len(counts))
+		return nil, fmt.Errorf("could not count email and fingerprint pairs in db (verification codes table). len(count)=%d", len(counts))
 	}
 
 	count = counts[0]
 	if count > 0 {
-		return "", fmt.Errorf("Verification mail has already been sent. It will expire within 1hr")
+		return nil, cmd.Errorf(cmd.CodeConflict, "Verification mail has already been sent. It will expire within 1hr")
 	}
 
 	///////////////////////////
@@ -274,29 +370,42 @@ func handleRegister(db *sql.DB, mail_sender mail.MailSender, to_email string, fi
 	)
 	_, err = insertStmt.Exec(tx)
 	if err != nil {
-		return "", fmt.Errorf("failed to insert verification code: %w", err)
-	}
-
-	ctx := context.Background()
-	err = mail_sender.SendConfirmation(ctx, to_email, verificationCode, fingerprint)
-	if err != nil {
-		return "", fmt.Errorf("Could not send confirmation mail: %s", err)
+		return nil, fmt.Errorf("failed to insert verification code: %w", err)
 	}
 
 	// Commit transaction
 	if err = tx.Commit(); err != nil {
-		return "", fmt.Errorf("failed to commit transaction: %w", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	// Queued after the commit, the outbox stores the mail in the database
+	// and sends it in the background
+	ctx := context.Background()
+	err = mail_sender.SendConfirmation(ctx, to_email, verificationCode, fingerprint, lang)
+	if err != nil {
+		// Drop the code so the caller can register again right away
+		_, deleteErr := table.VerificationCodes.DELETE().
+			WHERE(table.VerificationCodes.Fingerprint.EQ(String(fingerprint))).
+			Exec(db)
+		if deleteErr != nil {
+			log.Printf("failed to delete verification code: %v", deleteErr)
+		}
+		return nil, fmt.Errorf("Could not queue confirmation mail: %s", err)
 	}
 
-	return "Success: Confirmation mail sent", nil
+	return &cmd.Result{
+		Text: "Success: Confirmation mail queued",
+		Data: map[string]string{"email": to_email, "fingerprint": fingerprint},
+	}, nil
 }
 
-func handleConfirm(db *sql.DB, fingerprint string, code string) (info string, err error) {
-	// TODO: allow for multiple mails per fingerprint
+func handleConfirm(db *sql.DB, key ssh.PublicKey, code string) (*cmd.Result, error) {
+	fingerprint := gossh.FingerprintSHA256(key)
+
 	// Start transaction
 	tx, err := db.Begin()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer func() {
 		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
@@ -317,19 +426,27 @@ func handleConfirm(db *sql.DB, fingerprint string, code string) (info string, er
 		Query(tx, &emails)
 
 	if err != nil {
-		return "", fmt.Errorf("could not find verification request for fingerprint and code: %s", err)
+		return nil, fmt.Errorf("could not find verification request for fingerprint and code: %s", err)
 	}
 
 	if len(emails) > 1 {
-		return "", fmt.Errorf("too many matching verifications found: %d", len(emails))
+		return nil, fmt.Errorf("too many matching verifications found: %d", len(emails))
 	}
 
 	if len(emails) == 0 {
-		return "", fmt.Errorf("could not find verification request for fingerprint and code")
+		return nil, cmd.Errorf(cmd.CodeNotFound, "could not find verification request for fingerprint and code")
 	}
 
 	email := emails[0]
 
+	banned, err := isBanned(tx, email)
+	if err != nil {
+		return nil, err
+	}
+	if banned {
+		return nil, cmd.Errorf(cmd.CodePermissionDenied, "email is banned")
+	}
+
 	// Delete the verification record
 	_, err = table.VerificationCodes.DELETE().
 		WHERE(
@@ -341,39 +458,69 @@ func handleConfirm(db *sql.DB, fingerprint string, code string) (info string, er
 		Exec(tx)
 
 	if err != nil {
-		return "", fmt.Errorf("could not delete verification: %s", err)
+		return nil, fmt.Errorf("could not delete verification: %s", err)
+	}
+
+	// The first email confirmed for a key becomes its primary email
+	existingEmails, err := fingerprintEmails(tx, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	isPrimary := 0
+	if len(existingEmails) == 0 {
+		isPrimary = 1
 	}
 
 	// Create the SSH key entry
 	_, err = table.SSHKeys.INSERT(
 		table.SSHKeys.Fingerprint,
 		table.SSHKeys.Email,
+		table.SSHKeys.PublicKey,
+		table.SSHKeys.KeyType,
+		table.SSHKeys.KeyBits,
+		table.SSHKeys.IsPrimary,
 	).
 		VALUES(
 			fingerprint,
 			email,
+			authorizedKey(key),
+			key.Type(),
+			keyBits(key),
+			isPrimary,
 		).
 		Exec(tx)
 
 	if err != nil {
-		return "", fmt.Errorf("failed to register: %w", err)
+		return nil, fmt.Errorf("failed to register: %w", err)
+	}
+
+	_, err = translog.Append(tx, translog.Entry{
+		Op:          translog.OpConfirm,
+		EmailHash:   translog.HashEmail(email),
+		Fingerprint: fingerprint,
+		PublicKey:   authorizedKey(key),
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// Commit the transaction
 	err = tx.Commit()
 	if err != nil {
-		return "", fmt.Errorf("failed to commit transaction: %w", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return fmt.Sprintf("Success: email %s is now associated with fingerprint %s", email, fingerprint), nil
+	return cmd.Message("Success: email %s is now associated with fingerprint %s", email, fingerprint).
+		WithData(map[string]any{"email": email, "fingerprint": fingerprint, "primary": isPrimary == 1}), nil
 }
 
-func handleUnregister(db *sql.DB, fingerprint string) (info string, err error) {
-	// TODO: handle cases with more than 1 mail per fingerprint
+// handleUnregister removes email from the caller's key, whose emails are
+// given primary first
+func handleUnregister(db *sql.DB, fingerprint string, emails []string, email string) (*cmd.Result, error) {
 	// Start transaction
 	tx, err := db.Begin()
 	if err != nil {
-		return "", fmt.Errorf("failed to begin transaction: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer func() {
 		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
@@ -381,36 +528,132 @@ func handleUnregister(db *sql.DB, fingerprint string) (info string, err error) {
 		}
 	}()
 
-	// First get the user's email
-	var emails []string
-	err = SELECT(table.SSHKeys.Email).
-		FROM(table.SSHKeys).
-		WHERE(table.SSHKeys.Fingerprint.EQ(String(fingerprint))).
-		Query(tx, &emails)
+	if !slices.Contains(emails, email) {
+		return nil, cmd.Errorf(cmd.CodeNotFound, "email %s is not registered with this fingerprint", email)
+	}
+
+	if err = unregisterEmail(tx, fingerprint, email, emails); err != nil {
+		return nil, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	data := map[string]any{"email": email, "fingerprint": fingerprint, "registered": len(emails) > 1}
+	if len(emails) == 1 {
+		return &cmd.Result{Text: "Success: Your registration and all related permissions have been removed", Data: data}, nil
+	}
+	return cmd.Message("Success: email %s is no longer associated with fingerprint %s", email, fingerprint).WithData(data), nil
+}
 
+// handleSetPrimary makes email the primary one of the caller's key, whose
+// emails are given
+func handleSetPrimary(db *sql.DB, fingerprint string, emails []string, email string) (*cmd.Result, error) {
+	// Start transaction
+	tx, err := db.Begin()
 	if err != nil {
-		return "", fmt.Errorf("failed to query user email: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	if len(emails) == 0 {
-		return "", fmt.Errorf("no registration found for this fingerprint")
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	if !slices.Contains(emails, email) {
+		return nil, cmd.Errorf(cmd.CodeNotFound, "email %s is not registered with this fingerprint", email)
 	}
-	if len(emails) > 1 {
-		return "", fmt.Errorf("multiple registrations found for this fingerprint")
+
+	if err = setPrimaryEmail(tx, fingerprint, email); err != nil {
+		return nil, err
 	}
-	email := emails[0]
 
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return cmd.Message("Success: %s is now the primary email of fingerprint %s", email, fingerprint).
+		WithData(map[string]string{"email": email, "fingerprint": fingerprint}), nil
+}
+
+// handleSetLang stores the preferred language of the caller's key
+func handleSetLang(db *sql.DB, caller *cmd.Caller, code string) (*cmd.Result, error) {
+	lang, ok := i18n.Match(code)
+	if !ok {
+		return nil, cmd.Errorf(cmd.CodeInvalidArgument, "unsupported language %s, use one of: %s",
+			code, strings.Join(i18n.Languages(), ", "))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	_, err = table.KeyPreferences.INSERT(
+		table.KeyPreferences.Fingerprint,
+		table.KeyPreferences.Lang,
+	).VALUES(
+		String(caller.Fingerprint),
+		String(lang),
+	).ON_CONFLICT(table.KeyPreferences.Fingerprint).DO_UPDATE(
+		SET(
+			table.KeyPreferences.Lang.SET(table.KeyPreferences.EXCLUDED.Lang),
+			table.KeyPreferences.UpdatedAt.SET(table.KeyPreferences.EXCLUDED.UpdatedAt),
+		),
+	).Exec(tx)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to save language: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	// Answer in the new language already
+	caller.Lang = lang
+	return cmd.Message("Success: language set to %s", lang).
+		WithData(map[string]string{"fingerprint": caller.Fingerprint, "lang": lang}), nil
+}
+
+// setPrimaryEmail makes email the only primary email of the fingerprint
+func setPrimaryEmail(tx *sql.Tx, fingerprint, email string) error {
+	_, err := table.SSHKeys.UPDATE(table.SSHKeys.IsPrimary).
+		SET(CASE().
+			WHEN(table.SSHKeys.Email.EQ(String(email))).THEN(Int(1)).
+			ELSE(Int(0))).
+		WHERE(table.SSHKeys.Fingerprint.EQ(String(fingerprint))).
+		Exec(tx)
+	if err != nil {
+		return fmt.Errorf("failed to set primary email: %w", err)
+	}
+	return nil
+}
+
+// unregisterEmail removes email from the fingerprint, whose emails are given
+// primary first. Permissions go with the last key of the email, and pending
+// verifications and admin status with the last email of the key.
+func unregisterEmail(tx *sql.Tx, fingerprint, email string, emails []string) error {
 	// Count remaining keys for this email
 	var keyCount []int64
-	err = SELECT(COUNT(table.SSHKeys.Fingerprint)).
+	err := SELECT(COUNT(table.SSHKeys.Fingerprint)).
 		FROM(table.SSHKeys).
 		WHERE(table.SSHKeys.Email.EQ(String(email))).
 		Query(tx, &keyCount)
 
 	if err != nil {
-		return "", fmt.Errorf("failed to count remaining keys: %w", err)
+		return fmt.Errorf("failed to count remaining keys: %w", err)
 	}
 	if len(keyCount) != 1 {
-		return "", fmt.Errorf("failed to get key count")
+		return fmt.Errorf("failed to get key count")
 	}
 
 	// Only delete permissions if this is the last key
@@ -420,7 +663,7 @@ func handleUnregister(db *sql.DB, fingerprint string) (info string, err error) {
 			WHERE(table.EmailPermissions.GranterEmail.EQ(String(email))).
 			Exec(tx)
 		if err != nil {
-			return "", fmt.Errorf("failed to delete granted permissions: %w", err)
+			return fmt.Errorf("failed to delete granted permissions: %w", err)
 		}
 
 		// Delete all permissions where this user is the grantee
@@ -428,46 +671,67 @@ func handleUnregister(db *sql.DB, fingerprint string) (info string, err error) {
 			WHERE(table.EmailPermissions.GranteeEmail.EQ(String(email))).
 			Exec(tx)
 		if err != nil {
-			return "", fmt.Errorf("failed to delete received permissions: %w", err)
+			return fmt.Errorf("failed to delete received permissions: %w", err)
 		}
 	}
 
-	// Delete any pending verification codes for this fingerprint
-	_, err = table.VerificationCodes.DELETE().
-		WHERE(table.VerificationCodes.Fingerprint.EQ(String(fingerprint))).
-		Exec(tx)
-	if err != nil {
-		return "", fmt.Errorf("failed to delete verification codes: %w", err)
-	}
-	// Delete admin status for this user, if exists
-	_, err = table.AdminFingerprints.DELETE().
-		WHERE(table.AdminFingerprints.Fingerprint.EQ(String(fingerprint))).
-		Exec(tx)
-	if err != nil {
-		return "", fmt.Errorf("failed to delete admin status: %w", err)
+	// Only clean up the key itself if this is its last email
+	if len(emails) == 1 {
+		// Delete any pending verification codes for this fingerprint
+		_, err = table.VerificationCodes.DELETE().
+			WHERE(table.VerificationCodes.Fingerprint.EQ(String(fingerprint))).
+			Exec(tx)
+		if err != nil {
+			return fmt.Errorf("failed to delete verification codes: %w", err)
+		}
+		// Delete admin status for this user, if exists
+		_, err = table.AdminFingerprints.DELETE().
+			WHERE(table.AdminFingerprints.Fingerprint.EQ(String(fingerprint))).
+			Exec(tx)
+		if err != nil {
+			return fmt.Errorf("failed to delete admin status: %w", err)
+		}
+		_, err = table.KeyPreferences.DELETE().
+			WHERE(table.KeyPreferences.Fingerprint.EQ(String(fingerprint))).
+			Exec(tx)
+		if err != nil {
+			return fmt.Errorf("failed to delete preferences: %w", err)
+		}
 	}
 
 	// Delete the specific SSH key registration
 	result, err := table.SSHKeys.DELETE().
-		WHERE(table.SSHKeys.Fingerprint.EQ(String(fingerprint))).
+		WHERE(
+			AND(
+				table.SSHKeys.Fingerprint.EQ(String(fingerprint)),
+				table.SSHKeys.Email.EQ(String(email)),
+			),
+		).
 		Exec(tx)
 	if err != nil {
-		return "", fmt.Errorf("failed to delete registration: %w", err)
+		return fmt.Errorf("failed to delete registration: %w", err)
 	}
 
 	// Verify that we actually deleted a registration
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return "", fmt.Errorf("failed to get rows affected: %w", err)
+		return fmt.Errorf("failed to get rows affected: %w", err)
 	}
 	if rowsAffected == 0 {
-		return "", fmt.Errorf("no registration found for this fingerprint")
+		return cmd.Errorf(cmd.CodeNotFound, "no registration found for this fingerprint")
 	}
 
-	// Commit transaction
-	if err = tx.Commit(); err != nil {
-		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	// Promote the next oldest email if the primary one was removed
+	if email == emails[0] && len(emails) > 1 {
+		if err = setPrimaryEmail(tx, fingerprint, emails[1]); err != nil {
+			return err
+		}
 	}
 
-	return "Success: Your registration and all related permissions have been removed", nil
+	_, err = translog.Append(tx, translog.Entry{
+		Op:          translog.OpUnregister,
+		EmailHash:   translog.HashEmail(email),
+		Fingerprint: fingerprint,
+	})
+	return err
 }
@@ -3,57 +3,173 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
+	"slices"
 	"strings"
 	"time"
 
 	cmd "keypub/internal/command"
+	"keypub/internal/db/.gen/model"
 	"keypub/internal/db/.gen/table"
+	"keypub/internal/i18n"
+	"keypub/internal/mail"
+	"keypub/internal/translog"
 
 	. "github.com/go-jet/jet/v2/sqlite"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func registerCommandAdmin(registry *cmd.CommandRegistry) *cmd.CommandRegistry {
+func registerCommandAdmin(registry *cmd.CommandRegistry, rules *ruleCache) *cmd.CommandRegistry {
 
 	registry.Register(cmd.Command{
 		Name:        "admin",
 		Usage:       "admin <subcommand>",
 		Description: "Administrative commands",
 		Category:    "Admin",
+		Role:        cmd.RoleSupport,
 		Subcommands: map[string]cmd.Command{
 			"add": {
 				Name:        "add",
-				Usage:       "admin add <fingerprint>",
-				Description: "add a new admin fingerprint",
-				Handler: func(ctx *cmd.CommandContext) (string, error) {
-					return AddAdmin(ctx.DB, ctx.Fingerprint, ctx.Args[2])
+				Usage:       "admin add <fingerprint> [--role <role>]",
+				Description: "Add an admin fingerprint with the role owner, operator or support (default), or change the role of an admin",
+				Role:        cmd.RoleOwner,
+				Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+					role := ctx.Params.String("role")
+					if role == "" {
+						role = cmd.RoleSupport
+					}
+					return AddAdmin(ctx.DB, ctx.Params.String("fingerprint"), role)
 				},
 			},
 			"remove": {
 				Name:        "remove",
 				Usage:       "admin remove <fingerprint>",
 				Description: "remove an admin fingerprint",
-				Handler: func(ctx *cmd.CommandContext) (string, error) {
-					return RemoveAdmin(ctx.DB, ctx.Fingerprint, ctx.Args[2])
+				Role:        cmd.RoleOwner,
+				Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+					return RemoveAdmin(ctx.DB, ctx.Params.String("fingerprint"))
 				},
 			},
 			"list": {
 				Name:        "list",
 				Usage:       "admin list",
-				Description: "Print fingerprint list of admins",
-				Handler: func(ctx *cmd.CommandContext) (string, error) {
-					admins, err := ListAdmins(ctx.DB, ctx.Fingerprint)
+				Description: "Print fingerprint list of admins with their roles",
+				Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+					admins, err := ListAdmins(ctx.DB)
 					if err != nil {
-						return "", err
+						return nil, err
 					}
 					var output strings.Builder
 					output.WriteString("Admin fingerprints:\n")
+					data := []adminData{}
 					for _, admin := range admins {
-						output.WriteString(fmt.Sprintf("- %s\n", admin.Fingerprint))
+						output.WriteString(fmt.Sprintf("- %s (%s)\n", admin.Fingerprint, admin.Role))
+						data = append(data, adminData{Fingerprint: admin.Fingerprint, Role: admin.Role})
+					}
+					return &cmd.Result{
+						Text: output.String(),
+						Data: map[string][]adminData{"admins": data},
+					}, nil
+				},
+			},
+			"ban": {
+				Name:        "ban",
+				Role:        cmd.RoleOperator,
+				Usage:       "admin ban <fingerprint-or-email> [reason...]",
+				Description: "Reject a key at authentication, or prevent an email from being registered and looked up",
+				Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+					reason := strings.Join(ctx.Params.Strings("reason"), " ")
+					return AddBan(ctx.DB, ctx.Fingerprint, ctx.Params.String("fingerprint-or-email"), reason)
+				},
+			},
+			"unban": {
+				Name:        "unban",
+				Usage:       "admin unban <fingerprint-or-email>",
+				Description: "Lift the ban of a key or email",
+				Role:        cmd.RoleOperator,
+				Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+					return RemoveBan(ctx.DB, ctx.Params.String("fingerprint-or-email"))
+				},
+			},
+			"bans": {
+				Name:        "bans",
+				Usage:       "admin bans",
+				Description: "List banned keys and emails",
+				Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+					return ListBans(ctx.DB)
+				},
+			},
+			"stats": {
+				Name:        "stats",
+				Usage:       "admin stats [days]",
+				Description: "Show registry counts, registrations per day and mail failures over the last days (default 7)",
+				Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+					days, err := ctx.Params.Int("days", defaultStatsDays)
+					if err != nil {
+						return nil, cmd.Errorf(cmd.CodeInvalidArgument, "%s", err)
 					}
-					return output.String(), nil
+					return AdminStats(ctx.DB, days)
+				},
+			},
+			"user": {
+				Name:        "user",
+				Usage:       "admin user <email-or-fingerprint>",
+				Description: "Show what whoami shows for the user's keys, and their pending verifications",
+				Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+					return InspectUser(ctx.DB, ctx.Params.String("email-or-fingerprint"))
+				},
+			},
+			"remove-user": {
+				Name:        "remove-user",
+				Usage:       "admin remove-user <email>",
+				Description: "Unregister the email from all of its keys, as if each key unregistered it",
+				Role:        cmd.RoleOperator,
+				Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+					return RemoveUser(ctx.DB, ctx.Fingerprint, ctx.Params.String("email"))
+				},
+			},
+			"ratelimit": {
+				Name:        "ratelimit",
+				Usage:       "admin ratelimit <subcommand>",
+				Description: "Exempt keys and addresses from rate limiting, or block them",
+				Subcommands: map[string]cmd.Command{
+					"allow": {
+						Name:        "allow",
+						Usage:       "admin ratelimit allow <fingerprint-or-cidr>",
+						Description: "Never rate limit the key or address range",
+						Role:        cmd.RoleOperator,
+						Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+							return SetRateLimitRule(ctx.DB, rules, ctx.Fingerprint, ctx.Params.String("fingerprint-or-cidr"), ruleAllow)
+						},
+					},
+					"block": {
+						Name:        "block",
+						Usage:       "admin ratelimit block <fingerprint-or-cidr>",
+						Description: "Refuse all requests from the key or address range",
+						Role:        cmd.RoleOperator,
+						Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+							return SetRateLimitRule(ctx.DB, rules, ctx.Fingerprint, ctx.Params.String("fingerprint-or-cidr"), ruleBlock)
+						},
+					},
+					"remove": {
+						Name:        "remove",
+						Usage:       "admin ratelimit remove <fingerprint-or-cidr>",
+						Description: "Remove the rule of the key or address range",
+						Role:        cmd.RoleOperator,
+						Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+							return RemoveRateLimitRule(ctx.DB, rules, ctx.Params.String("fingerprint-or-cidr"))
+						},
+					},
+					"list": {
+						Name:        "list",
+						Usage:       "admin ratelimit list [fingerprint-or-cidr]",
+						Description: "List the rules, or the rule of the key or address range",
+						Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+							return ListRateLimitRules(ctx.DB, ctx.Params.String("fingerprint-or-cidr"))
+						},
+					},
 				},
 			},
 		},
@@ -62,19 +178,12 @@ func registerCommandAdmin(registry *cmd.CommandRegistry) *cmd.CommandRegistry {
 	registry.Register(cmd.Command{
 		Name:        "shutdown",
 		Usage:       "shutdown",
-		Description: "Gracefully shutdown the server (admin only)",
+		Description: "Gracefully shutdown the server (owners only)",
 		Category:    "Admin",
-		Handler: func(ctx *cmd.CommandContext) (string, error) {
+		Role:        cmd.RoleOwner,
+		Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
 			if ctx.Server == nil {
-				return "", fmt.Errorf("server shutdown not available")
-			}
-
-			isAdmin, err := IsAdmin(ctx.DB, ctx.Fingerprint)
-			if err != nil {
-				return "", err
-			}
-			if !isAdmin {
-				return "", fmt.Errorf("unauthorized")
+				return nil, fmt.Errorf("server shutdown not available")
 			}
 
 			go func() {
@@ -87,17 +196,33 @@ func registerCommandAdmin(registry *cmd.CommandRegistry) *cmd.CommandRegistry {
 				}
 			}()
 
-			return "Initiating graceful shutdown...", nil
+			return cmd.Message("Initiating graceful shutdown..."), nil
 		},
 	})
 
 	return registry
 }
 
-func IsAdmin(db *sql.DB, fingerprint string) (bool, error) {
+// countOwners returns the number of admins with the owner role
+func countOwners(tx *sql.Tx) (int64, error) {
+	count, err := queryCount(tx, SELECT(COUNT(STAR)).
+		FROM(table.AdminFingerprints).
+		WHERE(table.AdminFingerprints.Role.EQ(String(cmd.RoleOwner))))
+	if err != nil {
+		return 0, fmt.Errorf("failed to count owners: %w", err)
+	}
+	return count, nil
+}
+
+// AddAdmin adds an admin, or changes the role of an existing one
+func AddAdmin(db *sql.DB, newAdminFingerprint, role string) (*cmd.Result, error) {
+	if !cmd.ValidRole(role) {
+		return nil, cmd.Errorf(cmd.CodeInvalidArgument, "unknown role: %s, expected owner, operator or support", role)
+	}
+
 	tx, err := db.Begin()
 	if err != nil {
-		return false, fmt.Errorf("failed to begin transaction: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer func() {
 		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
@@ -105,30 +230,61 @@ func IsAdmin(db *sql.DB, fingerprint string) (bool, error) {
 		}
 	}()
 
-	var count []int64
-	err = SELECT(COUNT(table.AdminFingerprints.Fingerprint)).
-		FROM(table.AdminFingerprints).
-		WHERE(table.AdminFingerprints.Fingerprint.EQ(String(fingerprint))).
-		Query(tx, &count)
-
+	currentRole, err := adminRole(tx, newAdminFingerprint)
 	if err != nil {
-		return false, fmt.Errorf("failed to query admin status: %w", err)
+		return nil, err
 	}
-	if len(count) != 1 {
-		return false, fmt.Errorf("invalid count result")
+
+	text := "Admin added"
+	if currentRole == "" {
+		_, err = table.AdminFingerprints.
+			INSERT(table.AdminFingerprints.Fingerprint, table.AdminFingerprints.Role).
+			VALUES(String(newAdminFingerprint), String(role)).
+			Exec(tx)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to add admin: %w", err)
+		}
+	} else {
+		// Demoting the last owner would leave nobody to manage admins
+		if currentRole == cmd.RoleOwner && role != cmd.RoleOwner {
+			owners, err := countOwners(tx)
+			if err != nil {
+				return nil, err
+			}
+			if owners <= 1 {
+				return nil, cmd.Errorf(cmd.CodeConflict, "cannot demote last owner")
+			}
+		}
+
+		_, err = table.AdminFingerprints.
+			UPDATE(table.AdminFingerprints.Role).
+			SET(String(role)).
+			WHERE(table.AdminFingerprints.Fingerprint.EQ(String(newAdminFingerprint))).
+			Exec(tx)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to update admin role: %w", err)
+		}
+		text = "Admin role updated"
 	}
 
 	if err = tx.Commit(); err != nil {
-		return false, fmt.Errorf("failed to commit transaction: %w", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return count[0] > 0, nil
+	return &cmd.Result{
+		Text: fmt.Sprintf("%s: %s is now %s", text, newAdminFingerprint, role),
+		Data: adminData{Fingerprint: newAdminFingerprint, Role: role},
+	}, nil
 }
 
-func AddAdmin(db *sql.DB, callerFingerprint, newAdminFingerprint string) (info string, err error) {
+// BootstrapAdmins makes the configured fingerprints owners unless they are
+// admins already, so a fresh deployment has someone to add the other admins
+func BootstrapAdmins(db *sql.DB, fingerprints []string) error {
 	tx, err := db.Begin()
 	if err != nil {
-		return "", fmt.Errorf("failed to begin transaction: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer func() {
 		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
@@ -136,44 +292,102 @@ func AddAdmin(db *sql.DB, callerFingerprint, newAdminFingerprint string) (info s
 		}
 	}()
 
-	// Check if caller is admin
-	var count []int64
-	err = SELECT(COUNT(table.AdminFingerprints.Fingerprint)).
-		FROM(table.AdminFingerprints).
-		WHERE(table.AdminFingerprints.Fingerprint.EQ(String(callerFingerprint))).
-		Query(tx, &count)
+	var added []string
+	for _, fingerprint := range fingerprints {
+		if !strings.HasPrefix(fingerprint, "SHA256:") {
+			return fmt.Errorf("invalid bootstrap admin %q: expected a SHA256 fingerprint", fingerprint)
+		}
+
+		result, err := table.AdminFingerprints.
+			INSERT(table.AdminFingerprints.Fingerprint, table.AdminFingerprints.Role).
+			VALUES(String(fingerprint), String(cmd.RoleOwner)).
+			ON_CONFLICT(table.AdminFingerprints.Fingerprint).DO_NOTHING().
+			Exec(tx)
+
+		if err != nil {
+			return fmt.Errorf("failed to add bootstrap admin: %w", err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		if rowsAffected > 0 {
+			added = append(added, fingerprint)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
 
+	for _, fingerprint := range added {
+		log.Printf("Added bootstrap admin %s as %s", fingerprint, cmd.RoleOwner)
+	}
+	return nil
+}
+
+func RemoveAdmin(db *sql.DB, targetFingerprint string) (*cmd.Result, error) {
+	tx, err := db.Begin()
 	if err != nil {
-		return "", fmt.Errorf("failed to verify admin status: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	if len(count) != 1 {
-		return "", fmt.Errorf("invalid count result")
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	role, err := adminRole(tx, targetFingerprint)
+	if err != nil {
+		return nil, err
 	}
-	if count[0] == 0 {
-		return "", fmt.Errorf("unauthorized: only admins can add new admins")
+	if role == "" {
+		return nil, cmd.Errorf(cmd.CodeNotFound, "admin not found")
+	}
+
+	// Removing the last owner would leave nobody to manage admins
+	if role == cmd.RoleOwner {
+		owners, err := countOwners(tx)
+		if err != nil {
+			return nil, err
+		}
+		if owners <= 1 {
+			return nil, cmd.Errorf(cmd.CodeConflict, "cannot remove last owner")
+		}
 	}
 
-	// Add new admin
 	_, err = table.AdminFingerprints.
-		INSERT(table.AdminFingerprints.Fingerprint).
-		VALUES(String(newAdminFingerprint)).
+		DELETE().
+		WHERE(table.AdminFingerprints.Fingerprint.EQ(String(targetFingerprint))).
 		Exec(tx)
 
 	if err != nil {
-		return "", fmt.Errorf("failed to add admin: %w", err)
+		return nil, fmt.Errorf("failed to remove admin: %w", err)
 	}
 
 	if err = tx.Commit(); err != nil {
-		return "", fmt.Errorf("failed to commit transaction: %w", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return "Admin added", nil
+	return &cmd.Result{Text: "Admin removed", Data: map[string]string{"fingerprint": targetFingerprint}}, nil
+}
+
+// adminData is an admin in JSON output
+type adminData struct {
+	Fingerprint string `json:"fingerprint"`
+	Role        string `json:"role"`
+}
+
+type AdminInfo struct {
+	Fingerprint string
+	Role        string
+	CreatedAt   int32
 }
 
-func RemoveAdmin(db *sql.DB, callerFingerprint, targetFingerprint string) (info string, err error) {
+func ListAdmins(db *sql.DB) ([]AdminInfo, error) {
 	tx, err := db.Begin()
 	if err != nil {
-		return "", fmt.Errorf("failed to begin transaction: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer func() {
 		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
@@ -181,69 +395,166 @@ func RemoveAdmin(db *sql.DB, callerFingerprint, targetFingerprint string) (info
 		}
 	}()
 
-	// Check if caller is admin
-	var count []int64
-	err = SELECT(COUNT(table.AdminFingerprints.Fingerprint)).
-		FROM(table.AdminFingerprints).
-		WHERE(table.AdminFingerprints.Fingerprint.EQ(String(callerFingerprint))).
-		Query(tx, &count)
+	// Get all admins
+	var admins []AdminInfo
+	err = SELECT(
+		table.AdminFingerprints.Fingerprint.AS("admin_info.fingerprint"),
+		table.AdminFingerprints.Role.AS("admin_info.role"),
+		table.AdminFingerprints.CreatedAt.AS("admin_info.created_at"),
+	).FROM(
+		table.AdminFingerprints,
+	).ORDER_BY(
+		table.AdminFingerprints.CreatedAt.ASC(),
+	).Query(tx, &admins)
 
 	if err != nil {
-		return "", fmt.Errorf("failed to verify admin status: %w", err)
+		return nil, fmt.Errorf("failed to list admins: %w", err)
 	}
-	if len(count) != 1 {
-		return "", fmt.Errorf("invalid count result")
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return admins, nil
+}
+
+// IsBanned reports whether the fingerprint or email was banned by an admin
+func IsBanned(db *sql.DB, target string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	banned, err := isBanned(tx, target)
+	if err != nil {
+		return false, err
 	}
-	if count[0] == 0 {
-		return "", fmt.Errorf("unauthorized: only admins can remove admins")
+
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	// Check total admin count
-	err = SELECT(COUNT(table.AdminFingerprints.Fingerprint)).
-		FROM(table.AdminFingerprints).
-		Query(tx, &count)
+	return banned, nil
+}
 
+// validateBanTarget checks that a ban target is a key fingerprint or an email
+func validateBanTarget(target string) error {
+	if strings.HasPrefix(target, "SHA256:") {
+		return nil
+	}
+	if err := mail.ValidateEmail(target); err != nil {
+		return cmd.Errorf(cmd.CodeInvalidArgument, "invalid target: %s, expected a SHA256 fingerprint or an email", target)
+	}
+	return nil
+}
+
+func AddBan(db *sql.DB, callerFingerprint, target, reason string) (*cmd.Result, error) {
+	if err := validateBanTarget(target); err != nil {
+		return nil, err
+	}
+	if target == callerFingerprint {
+		return nil, cmd.Errorf(cmd.CodeConflict, "cannot ban your own key")
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
-		return "", fmt.Errorf("failed to count admins: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	if len(count) != 1 {
-		return "", fmt.Errorf("invalid count result")
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	banned, err := isBanned(tx, target)
+	if err != nil {
+		return nil, err
 	}
-	if count[0] <= 1 {
-		return "", fmt.Errorf("cannot remove last admin")
+	if banned {
+		return nil, cmd.Errorf(cmd.CodeConflict, "%s is already banned", target)
 	}
 
-	// Remove the admin
-	result, err := table.AdminFingerprints.
+	_, err = table.Bans.
+		INSERT(table.Bans.Target, table.Bans.Reason, table.Bans.CreatedBy).
+		VALUES(String(target), String(reason), String(callerFingerprint)).
+		Exec(tx)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to add ban: %w", err)
+	}
+
+	// A banned email must not be confirmed from a mail sent before the ban
+	_, err = table.VerificationCodes.
 		DELETE().
-		WHERE(table.AdminFingerprints.Fingerprint.EQ(String(targetFingerprint))).
+		WHERE(OR(
+			table.VerificationCodes.Email.EQ(String(target)),
+			table.VerificationCodes.Fingerprint.EQ(String(target)),
+		)).
+		Exec(tx)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete pending verifications: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &cmd.Result{
+		Text: fmt.Sprintf("%s banned", target),
+		Data: map[string]string{"target": target, "reason": reason},
+	}, nil
+}
+
+func RemoveBan(db *sql.DB, target string) (*cmd.Result, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	result, err := table.Bans.
+		DELETE().
+		WHERE(table.Bans.Target.EQ(String(target))).
 		Exec(tx)
 
 	if err != nil {
-		return "", fmt.Errorf("failed to remove admin: %w", err)
+		return nil, fmt.Errorf("failed to remove ban: %w", err)
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return "", fmt.Errorf("failed to get rows affected: %w", err)
+		return nil, fmt.Errorf("failed to get rows affected: %w", err)
 	}
 	if rowsAffected == 0 {
-		return "", fmt.Errorf("admin not found")
+		return nil, cmd.Errorf(cmd.CodeNotFound, "%s is not banned", target)
 	}
 
 	if err = tx.Commit(); err != nil {
-		return "", fmt.Errorf("failed to commit transaction: %w", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return "Admin removed", nil
+	return &cmd.Result{Text: fmt.Sprintf("%s unbanned", target), Data: map[string]string{"target": target}}, nil
 }
 
-type AdminInfo struct {
-	Fingerprint string
-	CreatedAt   int32
+// banInfo is a ban in JSON output
+type banInfo struct {
+	Target    string `json:"target"`
+	Reason    string `json:"reason,omitempty"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt string `json:"created_at"`
 }
 
-func ListAdmins(db *sql.DB, callerFingerprint string) ([]AdminInfo, error) {
+func ListBans(db *sql.DB) (*cmd.Result, error) {
 	tx, err := db.Begin()
 	if err != nil {
 		return nil, fmt.Errorf("failed to begin transaction: %w", err)
@@ -254,41 +565,333 @@ func ListAdmins(db *sql.DB, callerFingerprint string) ([]AdminInfo, error) {
 		}
 	}()
 
-	// Check if caller is admin
-	var count []int64
-	err = SELECT(COUNT(table.AdminFingerprints.Fingerprint)).
-		FROM(table.AdminFingerprints).
-		WHERE(table.AdminFingerprints.Fingerprint.EQ(String(callerFingerprint))).
-		Query(tx, &count)
+	var bans []model.Bans
+	err = SELECT(table.Bans.AllColumns).
+		FROM(table.Bans).
+		ORDER_BY(table.Bans.CreatedAt.ASC()).
+		Query(tx, &bans)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to verify admin status: %w", err)
+		return nil, fmt.Errorf("failed to list bans: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if len(bans) == 0 {
+		return &cmd.Result{Text: "No bans", Data: map[string][]banInfo{"bans": {}}}, nil
+	}
+
+	var output strings.Builder
+	data := []banInfo{}
+	output.WriteString("Bans:\n")
+	for _, ban := range bans {
+		createdAt := time.Unix(int64(ban.CreatedAt), 0).Format(time.RFC3339)
+		data = append(data, banInfo{
+			Target:    ban.Target,
+			Reason:    ban.Reason,
+			CreatedBy: ban.CreatedBy,
+			CreatedAt: createdAt,
+		})
+		if ban.Reason != "" {
+			output.WriteString(fmt.Sprintf("- %s: %s (banned %s by %s)\n", ban.Target, ban.Reason, createdAt, ban.CreatedBy))
+		} else {
+			output.WriteString(fmt.Sprintf("- %s (banned %s by %s)\n", ban.Target, createdAt, ban.CreatedBy))
+		}
+	}
+
+	return &cmd.Result{
+		Text: strings.TrimSuffix(output.String(), "\n"),
+		Data: map[string][]banInfo{"bans": data},
+	}, nil
+}
+
+// Bounds of the days argument of admin stats
+const (
+	defaultStatsDays = 7
+	maxStatsDays     = 366
+)
+
+// dailyCount is the number of emails confirmed on one UTC day
+type dailyCount struct {
+	Date  string `json:"date"`
+	Count int64  `json:"count"`
+}
+
+// adminStats is the JSON output of admin stats
+type adminStats struct {
+	Keys                 int64        `json:"keys"`
+	Emails               int64        `json:"emails"`
+	PendingVerifications int64        `json:"pending_verifications"`
+	Permissions          int64        `json:"permissions"`
+	MailFailures         int64        `json:"mail_failures"`
+	RecentMailFailures   int64        `json:"recent_mail_failures"`
+	Days                 int          `json:"days"`
+	Registrations        []dailyCount `json:"registrations"`
+}
+
+// queryCount runs a SELECT COUNT statement
+func queryCount(tx *sql.Tx, stmt SelectStatement) (int64, error) {
+	var count []int64
+	if err := stmt.Query(tx, &count); err != nil {
+		return 0, err
 	}
 	if len(count) != 1 {
-		return nil, fmt.Errorf("invalid count result")
+		return 0, fmt.Errorf("invalid count result")
 	}
-	if count[0] == 0 {
-		return nil, fmt.Errorf("unauthorized: only admins can list admins")
+	return count[0], nil
+}
+
+func AdminStats(db *sql.DB, days int) (*cmd.Result, error) {
+	if days < 1 || days > maxStatsDays {
+		return nil, cmd.Errorf(cmd.CodeInvalidArgument, "days must be between 1 and %d", maxStatsDays)
 	}
 
-	// Get all admins
-	var admins []AdminInfo
-	err = SELECT(
-		table.AdminFingerprints.Fingerprint.AS("admin_info.fingerprint"),
-		table.AdminFingerprints.CreatedAt.AS("admin_info.created_at"),
-	).FROM(
-		table.AdminFingerprints,
-	).ORDER_BY(
-		table.AdminFingerprints.CreatedAt.ASC(),
-	).Query(tx, &admins)
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	// Days are UTC, today included
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	since := today.AddDate(0, 0, 1-days)
+
+	stats := adminStats{Days: days}
+	counts := []struct {
+		name  string
+		value *int64
+		stmt  SelectStatement
+	}{
+		{"keys", &stats.Keys, SELECT(COUNT(DISTINCT(table.SSHKeys.Fingerprint))).FROM(table.SSHKeys)},
+		{"emails", &stats.Emails, SELECT(COUNT(DISTINCT(table.SSHKeys.Email))).FROM(table.SSHKeys)},
+		{"pending verifications", &stats.PendingVerifications, SELECT(COUNT(STAR)).FROM(table.VerificationCodes)},
+		{"permissions", &stats.Permissions, SELECT(COUNT(STAR)).FROM(table.EmailPermissions)},
+		{"mail failures", &stats.MailFailures, SELECT(COUNT(STAR)).FROM(table.MailFailures)},
+		{"recent mail failures", &stats.RecentMailFailures, SELECT(COUNT(STAR)).
+			FROM(table.MailFailures).
+			WHERE(table.MailFailures.CreatedAt.GT_EQ(Int(since.Unix())))},
+	}
+	for _, count := range counts {
+		if *count.value, err = queryCount(tx, count.stmt); err != nil {
+			return nil, fmt.Errorf("failed to count %s: %w", count.name, err)
+		}
+	}
+
+	// Registrations are the confirm entries of the transparency log, which
+	// unlike ssh_keys keeps those of keys and emails removed since. Bucketed
+	// here rather than in SQL, by the timestamp of the entry.
+	var leaves []string
+	err = SELECT(table.TransparencyLog.LeafData).
+		FROM(table.TransparencyLog).
+		WHERE(table.TransparencyLog.CreatedAt.GT_EQ(Int(since.Unix()))).
+		Query(tx, &leaves)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to list admins: %w", err)
+		return nil, fmt.Errorf("failed to query registrations: %w", err)
 	}
 
 	if err = tx.Commit(); err != nil {
 		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return admins, nil
+	stats.Registrations = make([]dailyCount, days)
+	for i := range stats.Registrations {
+		stats.Registrations[i].Date = since.AddDate(0, 0, i).Format(time.DateOnly)
+	}
+	for _, leaf := range leaves {
+		var entry translog.Entry
+		if err := json.Unmarshal([]byte(leaf), &entry); err != nil {
+			return nil, fmt.Errorf("failed to decode log entry: %w", err)
+		}
+		if entry.Op != translog.OpConfirm {
+			continue
+		}
+		day := int(time.Unix(entry.Timestamp, 0).UTC().Sub(since) / (24 * time.Hour))
+		if day >= 0 && day < days {
+			stats.Registrations[day].Count++
+		}
+	}
+
+	var output strings.Builder
+	output.WriteString(fmt.Sprintf("Registered keys: %d\n", stats.Keys))
+	output.WriteString(fmt.Sprintf("Distinct emails: %d\n", stats.Emails))
+	output.WriteString(fmt.Sprintf("Pending verifications: %d\n", stats.PendingVerifications))
+	output.WriteString(fmt.Sprintf("Permissions: %d\n", stats.Permissions))
+	output.WriteString(fmt.Sprintf("Mail failures: %d (%d in the last %d days)\n", stats.MailFailures, stats.RecentMailFailures, days))
+	output.WriteString(fmt.Sprintf("\nRegistrations in the last %d days:\n", days))
+	for _, registrations := range stats.Registrations {
+		output.WriteString(fmt.Sprintf("%s: %d\n", registrations.Date, registrations.Count))
+	}
+
+	return &cmd.Result{Text: strings.TrimSuffix(output.String(), "\n"), Data: stats}, nil
+}
+
+// emailFingerprints returns the fingerprints registered with the email, oldest first
+func emailFingerprints(tx *sql.Tx, email string) ([]string, error) {
+	var fingerprints []string
+	err := SELECT(table.SSHKeys.Fingerprint).
+		FROM(table.SSHKeys).
+		WHERE(table.SSHKeys.Email.EQ(String(email))).
+		ORDER_BY(table.SSHKeys.CreatedAt.ASC()).
+		Query(tx, &fingerprints)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query fingerprints for email: %w", err)
+	}
+	return fingerprints, nil
+}
+
+// pendingVerification is a verification code in admin user output
+type pendingVerification struct {
+	Email       string `json:"email"`
+	Fingerprint string `json:"fingerprint"`
+	Code        string `json:"code"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// adminUserData is the JSON output of admin user
+type adminUserData struct {
+	Keys                 []whoamiData          `json:"keys"`
+	PendingVerifications []pendingVerification `json:"pending_verifications"`
+}
+
+func InspectUser(db *sql.DB, target string) (*cmd.Result, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	// A fingerprint is one key, an email is every key registered with it
+	fingerprints := []string{target}
+	pendingCondition := table.VerificationCodes.Fingerprint.EQ(String(target))
+	if !strings.HasPrefix(target, "SHA256:") {
+		fingerprints, err = emailFingerprints(tx, target)
+		if err != nil {
+			return nil, err
+		}
+		pendingCondition = table.VerificationCodes.Email.EQ(String(target))
+	}
+
+	var output strings.Builder
+	data := adminUserData{Keys: []whoamiData{}, PendingVerifications: []pendingVerification{}}
+	for _, fingerprint := range fingerprints {
+		if output.Len() > 0 {
+			output.WriteString("\n")
+		}
+		emails, err := fingerprintEmails(tx, fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		keyData, err := describeKey(tx, fingerprint, emails, i18n.DefaultLang, &output)
+		if err != nil {
+			return nil, err
+		}
+		if keyData.Registered {
+			data.Keys = append(data.Keys, keyData)
+		}
+	}
+
+	var pending []model.VerificationCodes
+	err = SELECT(table.VerificationCodes.AllColumns).
+		FROM(table.VerificationCodes).
+		WHERE(pendingCondition).
+		ORDER_BY(table.VerificationCodes.CreatedAt.ASC()).
+		Query(tx, &pending)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pending verifications: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if len(data.Keys) == 0 && len(pending) == 0 {
+		return nil, cmd.Errorf(cmd.CodeNotFound, "no user found for %s", target)
+	}
+
+	if len(pending) > 0 {
+		if output.Len() > 0 {
+			output.WriteString("\n")
+		}
+		output.WriteString("Pending verifications:\n")
+		for _, verification := range pending {
+			createdAt := time.Unix(int64(verification.CreatedAt), 0).Format(time.RFC3339)
+			data.PendingVerifications = append(data.PendingVerifications, pendingVerification{
+				Email:       verification.Email,
+				Fingerprint: verification.Fingerprint,
+				Code:        verification.Code,
+				CreatedAt:   createdAt,
+			})
+			output.WriteString(fmt.Sprintf("- %s %s code %s (sent: %s)\n",
+				verification.Email, verification.Fingerprint, verification.Code, createdAt))
+		}
+	}
+
+	return &cmd.Result{Text: strings.TrimSuffix(output.String(), "\n"), Data: data}, nil
+}
+
+func RemoveUser(db *sql.DB, callerFingerprint, email string) (*cmd.Result, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	fingerprints, err := emailFingerprints(tx, email)
+	if err != nil {
+		return nil, err
+	}
+	if len(fingerprints) == 0 {
+		return nil, cmd.Errorf(cmd.CodeNotFound, "email %s is not registered", email)
+	}
+	if slices.Contains(fingerprints, callerFingerprint) {
+		return nil, cmd.Errorf(cmd.CodeConflict, "cannot remove your own user, use unregister")
+	}
+
+	// Each key unregisters the email in turn, so the last one also takes
+	// the permissions of the email with it
+	for _, fingerprint := range fingerprints {
+		emails, err := fingerprintEmails(tx, fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		if err = unregisterEmail(tx, fingerprint, email, emails); err != nil {
+			return nil, err
+		}
+	}
+
+	// Mails sent to the address before can no longer be confirmed
+	_, err = table.VerificationCodes.
+		DELETE().
+		WHERE(table.VerificationCodes.Email.EQ(String(email))).
+		Exec(tx)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete pending verifications: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &cmd.Result{
+		Text: fmt.Sprintf("Success: email %s removed from %d key(s)", email, len(fingerprints)),
+		Data: map[string]any{"email": email, "fingerprints": fingerprints},
+	}, nil
 }
@@ -10,11 +10,11 @@ func registerCommandInfo(registry *cmd.CommandRegistry) *cmd.CommandRegistry {
 
 	registry.Register(cmd.Command{
 		Name:        "help",
-		Usage:       "help",
-		Description: "Understand the motivation behind this project and how it helps solve common SSH key management challenges.",
+		Usage:       "help [command...]",
+		Description: "List the available commands, or show the usage of the given command or subcommand.",
 		Category:    "Info",
-		Handler: func(ctx *cmd.CommandContext) (info string, err error) {
-			return registry.GetHelpText(), nil
+		Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+			return registry.GetCommandHelp(ctx.Params.Strings("command"), ctx.Lang())
 		},
 	})
 	registry.Register(cmd.Command{
@@ -22,12 +22,12 @@ func registerCommandInfo(registry *cmd.CommandRegistry) *cmd.CommandRegistry {
 		Usage:       "about",
 		Description: "Learn about this service and how it helps map SSH keys to email addresses while protecting user privacy.",
 		Category:    "Info",
-		Handler: func(ctx *cmd.CommandContext) (info string, err error) {
-			return `* Verified registry linking SSH public keys to email addresses
+		Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+			return &cmd.Result{Text: `* Verified registry linking SSH public keys to email addresses
 * No installation or configuration needed - works with your existing SSH setup
 * Privacy-focused: you control what information is public or private
 * Simple email verification process
-* Free public service`, nil
+* Free public service`}, nil
 		},
 	})
 	registry.Register(cmd.Command{
@@ -35,12 +35,12 @@ func registerCommandInfo(registry *cmd.CommandRegistry) *cmd.CommandRegistry {
 		Usage:       "why",
 		Description: "Understand the motivation behind this project and how it helps solve common SSH key management challenges.",
 		Category:    "Info",
-		Handler: func(ctx *cmd.CommandContext) (info string, err error) {
-			return `* Single verified identity for all SSH-based applications - register once, use everywhere
+		Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+			return &cmd.Result{Text: `* Single verified identity for all SSH-based applications - register once, use everywhere
 * Perfect for SSH application developers - no need to build and maintain user verification systems
 * Users control their privacy - they decide which applications can access their email
 * Lightweight alternative to OAuth for CLI applications - just use SSH keys that users already have
-* Central identity system that respects privacy and puts users in control`, nil
+* Central identity system that respects privacy and puts users in control`}, nil
 		},
 	})
 
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	cmd "keypub/internal/command"
+	"keypub/internal/translog"
+
+	"github.com/gliderlabs/ssh"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func registerCommandLog(registry *cmd.CommandRegistry) *cmd.CommandRegistry {
+
+	registry.Register(cmd.Command{
+		Name:        "log",
+		Usage:       "log <subcommand>",
+		Description: "Audit the transparency log of all registrations, removals and permission changes",
+		Category:    "Transparency",
+		Subcommands: map[string]cmd.Command{
+			"head": {
+				Name:        "head",
+				Usage:       "log head",
+				Description: "Get the current tree head, signed with the server host key",
+				Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+					return handleLogHead(ctx.DB, ctx.HostSigner)
+				},
+			},
+			"proof": {
+				Name:        "proof",
+				Usage:       "log proof <index>",
+				Description: "Get the log entry at index and its inclusion proof in the current tree",
+				Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+					return handleLogProof(ctx.DB, ctx.HostSigner, ctx.Params.String("index"))
+				},
+			},
+			"consistency": {
+				Name:        "consistency",
+				Usage:       "log consistency <old> <new>",
+				Description: "Get the proof that the tree of size old is a prefix of the tree of size new",
+				Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+					return handleLogConsistency(ctx.DB, ctx.Params.String("old"), ctx.Params.String("new"))
+				},
+			},
+		},
+	})
+	return registry
+}
+
+func parseTreeSize(s string) (uint64, error) {
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, cmd.Errorf(cmd.CodeInvalidArgument, "invalid tree size or index: %s", s)
+	}
+	return n, nil
+}
+
+func handleLogHead(db *sql.DB, signer ssh.Signer) (*cmd.Result, error) {
+	// Start transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	head, err := translog.SignedHead(tx, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &cmd.Result{Text: head.String(), Data: head}, nil
+}
+
+func handleLogProof(db *sql.DB, signer ssh.Signer, indexArg string) (*cmd.Result, error) {
+	index, err := parseTreeSize(indexArg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	proof, err := translog.ProveInclusion(tx, signer, index)
+	if errors.Is(err, translog.ErrInvalidIndex) {
+		return nil, cmd.Errorf(cmd.CodeNotFound, "no log entry at index %d", index)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &cmd.Result{Text: proof.String(), Data: proof}, nil
+}
+
+func handleLogConsistency(db *sql.DB, oldArg, newArg string) (*cmd.Result, error) {
+	oldSize, err := parseTreeSize(oldArg)
+	if err != nil {
+		return nil, err
+	}
+	newSize, err := parseTreeSize(newArg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	proof, err := translog.ProveConsistency(tx, oldSize, newSize)
+	if errors.Is(err, translog.ErrInvalidIndex) {
+		return nil, cmd.Errorf(cmd.CodeInvalidArgument, "tree sizes must satisfy old <= new <= current tree size")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &cmd.Result{Text: proof.String(), Data: proof}, nil
+}
@@ -4,9 +4,12 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"slices"
+	"strings"
 
 	cmd "keypub/internal/command"
 	"keypub/internal/db/.gen/table"
+	"keypub/internal/mail"
 
 	. "github.com/go-jet/jet/v2/sqlite"
 	_ "github.com/mattn/go-sqlite3"
@@ -19,14 +22,23 @@ func registerCommandLookup(registry *cmd.CommandRegistry) *cmd.CommandRegistry {
 		Usage:       "get <subcommand>",
 		Description: "Get information about users",
 		Category:    "Information",
+		Middleware:  []cmd.Middleware{cmd.RequireRegistered},
 		Subcommands: map[string]cmd.Command{
 			"email": {
 				Name:        "email",
 				Usage:       "get email <fingerprint>",
-				Description: "Get email for the given fingerprint (if authorized)",
-				Handler: func(ctx *cmd.CommandContext) (string, error) {
-					targetFingerprint := ctx.Args[2]
-					return handleGetEmail(ctx.DB, ctx.Fingerprint, targetFingerprint)
+				Description: "Get the emails of the given fingerprint you are authorized to see, primary first",
+				Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+					targetFingerprint := ctx.Params.String("fingerprint")
+					return handleGetEmail(ctx.DB, ctx.Caller.Emails, targetFingerprint)
+				},
+			},
+			"keys": {
+				Name:        "keys",
+				Usage:       "get keys <email>",
+				Description: "Get all verified keys of the given email in authorized_keys format (if authorized)",
+				Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+					return handleGetKeys(ctx.DB, ctx.Caller.Emails, ctx.Params.String("email"))
 				},
 			},
 		},
@@ -34,12 +46,11 @@ func registerCommandLookup(registry *cmd.CommandRegistry) *cmd.CommandRegistry {
 	return registry
 }
 
-func handleGetEmail(db *sql.DB, callerFingerprint, targetFingerprint string) (string, error) {
-	// TODO: handle cases with more than 1 mail per fingerprint
+func handleGetEmail(db *sql.DB, callerEmails []string, targetFingerprint string) (*cmd.Result, error) {
 	// Start transaction
 	tx, err := db.Begin()
 	if err != nil {
-		return "", fmt.Errorf("failed to begin transaction: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer func() {
 		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
@@ -47,63 +58,122 @@ func handleGetEmail(db *sql.DB, callerFingerprint, targetFingerprint string) (st
 		}
 	}()
 
-	// First get the caller's email
-	var callerEmails []string
-	err = SELECT(table.SSHKeys.Email).
-		FROM(table.SSHKeys).
-		WHERE(table.SSHKeys.Fingerprint.EQ(String(callerFingerprint))).
-		Query(tx, &callerEmails)
+	// Get target's emails, primary first
+	targetEmails, err := fingerprintEmails(tx, targetFingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query target info: %w", err)
+	}
+
+	// Keep the emails the caller owns or was allowed to see, unless banned
+	var visibleEmails []string
+	for _, targetEmail := range targetEmails {
+		banned, err := isBanned(tx, targetEmail)
+		if err != nil {
+			return nil, err
+		}
+		if banned {
+			continue
+		}
+
+		visible := slices.Contains(callerEmails, targetEmail)
+		if !visible {
+			visible, err = hasPermission(tx, targetEmail, callerEmails)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if visible {
+			visibleEmails = append(visibleEmails, targetEmail)
+		}
+	}
+	if len(visibleEmails) == 0 {
+		return nil, cmd.Errorf(cmd.CodeNotFound, "no email found or permission denied")
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &cmd.Result{
+		Text: strings.Join(visibleEmails, "\n"),
+		Data: map[string]any{"fingerprint": targetFingerprint, "emails": visibleEmails},
+	}, nil
+}
 
+func handleGetKeys(db *sql.DB, callerEmails []string, targetEmail string) (*cmd.Result, error) {
+	err := mail.ValidateEmail(targetEmail)
 	if err != nil {
-		return "", fmt.Errorf("failed to query caller info: %w", err)
+		return nil, cmd.Errorf(cmd.CodeInvalidArgument, "mail address fails validation")
 	}
-	if len(callerEmails) == 0 {
-		return "", fmt.Errorf("caller not registered")
+	// Start transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	if len(callerEmails) > 1 {
-		return "", fmt.Errorf("multiple emails found for caller fingerprint")
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	banned, err := isBanned(tx, targetEmail)
+	if err != nil {
+		return nil, err
+	}
+	if banned {
+		return nil, cmd.Errorf(cmd.CodeNotFound, "no keys found or permission denied")
 	}
-	callerEmail := callerEmails[0]
 
-	// Get target's email and check permissions
-	type TargetInfo struct {
-		Email string
+	// Unless the caller is looking up their own keys, they need permission
+	if !slices.Contains(callerEmails, targetEmail) {
+		allowed, err := hasPermission(tx, targetEmail, callerEmails)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			return nil, cmd.Errorf(cmd.CodeNotFound, "no keys found or permission denied")
+		}
 	}
-	var targetInfo []TargetInfo
-	err = SELECT(
-		table.SSHKeys.Email.AS("target_info.email"),
-	).FROM(
-		table.SSHKeys.
-			LEFT_JOIN(table.EmailPermissions, AND(
-				table.EmailPermissions.GranterEmail.EQ(table.SSHKeys.Email),
-				table.EmailPermissions.GranteeEmail.EQ(String(callerEmail)),
-			)),
-	).WHERE(
-		AND(
-			table.SSHKeys.Fingerprint.EQ(String(targetFingerprint)),
-			OR(
-				// Either the caller is looking up their own email
-				table.SSHKeys.Email.EQ(String(callerEmail)),
-				// Or they have permission
-				table.EmailPermissions.GranteeEmail.IS_NOT_NULL(),
+
+	// Keys registered before public keys were stored are skipped until
+	// backfilled, banned keys are left out
+	var publicKeys []string
+	err = SELECT(table.SSHKeys.PublicKey).
+		FROM(table.SSHKeys).
+		WHERE(
+			AND(
+				table.SSHKeys.Email.EQ(String(targetEmail)),
+				table.SSHKeys.PublicKey.IS_NOT_NULL(),
+				table.SSHKeys.Fingerprint.NOT_IN(SELECT(table.Bans.Target).FROM(table.Bans)),
 			),
-		),
-	).Query(tx, &targetInfo)
+		).
+		ORDER_BY(table.SSHKeys.CreatedAt.ASC()).
+		Query(tx, &publicKeys)
 
 	if err != nil {
-		return "", fmt.Errorf("failed to query target info: %w", err)
+		return nil, fmt.Errorf("failed to query keys: %w", err)
 	}
-	if len(targetInfo) == 0 {
-		return "", fmt.Errorf("no email found or permission denied")
-	}
-	if len(targetInfo) > 1 {
-		return "", fmt.Errorf("multiple emails found for target fingerprint")
+	if len(publicKeys) == 0 {
+		return nil, cmd.Errorf(cmd.CodeNotFound, "no keys found or permission denied")
 	}
 
 	// Commit transaction
 	if err = tx.Commit(); err != nil {
-		return "", fmt.Errorf("failed to commit transaction: %w", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	// One authorized_keys line per key, commented with the owner's email
+	var result strings.Builder
+	for i, publicKey := range publicKeys {
+		if i > 0 {
+			result.WriteString("\n")
+		}
+		result.WriteString(fmt.Sprintf("%s %s", publicKey, targetEmail))
 	}
 
-	return targetInfo[0].Email, nil
+	return &cmd.Result{
+		Text: result.String(),
+		Data: map[string]any{"email": targetEmail, "keys": publicKeys},
+	}, nil
 }
@@ -4,10 +4,12 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"slices"
 
 	cmd "keypub/internal/command"
 	"keypub/internal/db/.gen/table"
 	"keypub/internal/mail"
+	"keypub/internal/translog"
 
 	. "github.com/go-jet/jet/v2/sqlite"
 	_ "github.com/mattn/go-sqlite3"
@@ -17,35 +19,40 @@ func registerCommandRegistration(registry *cmd.CommandRegistry) *cmd.CommandRegi
 
 	registry.Register(cmd.Command{
 		Name:        "allow",
-		Usage:       "allow <email>",
-		Description: `Grant permission to the given email address to see your email. The user must be registered in the system.`,
+		Usage:       "allow <email> [--as <your-email>]",
+		Description: `Grant permission to the given email address to see your primary email, or the one given with --as. The user must be registered in the system.`,
 		Category:    "Privacy Control",
-		Handler: func(ctx *cmd.CommandContext) (info string, err error) {
-			return handleAllow(ctx.DB, ctx.Args[1], ctx.Fingerprint)
+		Middleware:  []cmd.Middleware{cmd.RequireRegistered},
+		Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+			return handleAllow(ctx.DB, ctx.Params.String("email"), ctx.Params.String("as"), ctx.Caller)
 		}})
 	registry.Register(cmd.Command{
 		Name:        "deny",
-		Usage:       "deny <email>",
-		Description: `Remove permission for the given email address to see your email.`,
+		Usage:       "deny <email> [--as <your-email>]",
+		Description: `Remove permission for the given email address to see your primary email, or the one given with --as.`,
 		Category:    "Privacy Control",
-		Handler: func(ctx *cmd.CommandContext) (info string, err error) {
-			return handleDeny(ctx.DB, ctx.Args[1], ctx.Fingerprint)
+		Middleware:  []cmd.Middleware{cmd.RequireRegistered},
+		Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+			return handleDeny(ctx.DB, ctx.Params.String("email"), ctx.Params.String("as"), ctx.Caller)
 		},
 	})
 	return registry
 }
 
-func handleAllow(db *sql.DB, email, fingerprint string) (info string, err error) {
-	// TODO: early exit for self allow
-	// TODO: handle cases with more than 1 mail per fingerprint
-	// Start transaction
-	err = mail.ValidateEmail(email)
+// permissionData is the JSON output of allow and deny
+func permissionData(granterEmail, granteeEmail string, allowed bool) map[string]any {
+	return map[string]any{"granter": granterEmail, "grantee": granteeEmail, "allowed": allowed}
+}
+
+func handleAllow(db *sql.DB, email, as string, caller *cmd.Caller) (*cmd.Result, error) {
+	err := mail.ValidateEmail(email)
 	if err != nil {
-		return "", fmt.Errorf("mail address fails validation")
+		return nil, cmd.Errorf(cmd.CodeInvalidArgument, "mail address fails validation")
 	}
+	// Start transaction
 	tx, err := db.Begin()
 	if err != nil {
-		return "", fmt.Errorf("failed to begin transaction: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer func() {
 		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
@@ -53,28 +60,16 @@ func handleAllow(db *sql.DB, email, fingerprint string) (info string, err error)
 		}
 	}()
 
-	// Get the email of the user with the given fingerprint
-	var granterEmails []string
-	err = SELECT(table.SSHKeys.Email).
-		FROM(table.SSHKeys).
-		WHERE(table.SSHKeys.Fingerprint.EQ(String(fingerprint))).
-		Query(tx, &granterEmails)
-
-	if err != nil {
-		return "", fmt.Errorf("failed to query fingerprint owner: %w", err)
-	}
-	if len(granterEmails) == 0 {
-		return "", fmt.Errorf("no user found with fingerprint: %s", fingerprint)
+	// Permissions are granted on behalf of the caller's primary email unless
+	// another one of their emails is given
+	granterEmails := caller.Emails
+	if slices.Contains(granterEmails, email) {
+		return nil, cmd.Errorf(cmd.CodeInvalidArgument, "you can't allow yourself, use whoami instead.")
 	}
-	for _, granterEmail := range granterEmails {
-		if granterEmail == email {
-			return "", fmt.Errorf("you can't allow yourself, use whoami instead.")
-		}
-	}
-	if len(granterEmails) > 1 {
-		return "", fmt.Errorf("multiple users found with same fingerprint: %s", fingerprint)
+	granterEmail, err := selectGranterEmail(granterEmails, as)
+	if err != nil {
+		return nil, err
 	}
-	granterEmail := granterEmails[0]
 
 	// Check if the grantee exists (has any SSH keys)
 	var granteeCount []int64
@@ -84,13 +79,13 @@ func handleAllow(db *sql.DB, email, fingerprint string) (info string, err error)
 		Query(tx, &granteeCount)
 
 	if err != nil {
-		return "", fmt.Errorf("failed to query grantee existence: %w", err)
+		return nil, fmt.Errorf("failed to query grantee existence: %w", err)
 	}
 	if len(granteeCount) != 1 {
-		return "", fmt.Errorf("failed to count grantee records")
+		return nil, fmt.Errorf("failed to count grantee records")
 	}
 	if granteeCount[0] == 0 {
-		return "", fmt.Errorf("no user found with email: %s", email)
+		return nil, cmd.Errorf(cmd.CodeNotFound, "no user found with email: %s", email)
 	}
 
 	// Check if permission already exists
@@ -106,13 +101,13 @@ func handleAllow(db *sql.DB, email, fingerprint string) (info string, err error)
 		Query(tx, &permissionCount)
 
 	if err != nil {
-		return "", fmt.Errorf("failed to query existing permissions: %w", err)
+		return nil, fmt.Errorf("failed to query existing permissions: %w", err)
 	}
 	if len(permissionCount) != 1 {
-		return "", fmt.Errorf("failed to count existing permissions")
+		return nil, fmt.Errorf("failed to count existing permissions")
 	}
 	if permissionCount[0] > 0 {
-		return "permission already exists", nil
+		return &cmd.Result{Text: "permission already exists", Data: permissionData(granterEmail, email, true)}, nil
 	}
 
 	// Insert new permission
@@ -125,27 +120,37 @@ func handleAllow(db *sql.DB, email, fingerprint string) (info string, err error)
 	).Exec(tx)
 
 	if err != nil {
-		return "", fmt.Errorf("failed to insert permission: %w", err)
+		return nil, fmt.Errorf("failed to insert permission: %w", err)
+	}
+
+	_, err = translog.Append(tx, translog.Entry{
+		Op:          translog.OpAllow,
+		EmailHash:   translog.HashEmail(granterEmail),
+		Fingerprint: caller.Fingerprint,
+		GranteeHash: translog.HashEmail(email),
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// Commit transaction
 	if err = tx.Commit(); err != nil {
-		return "", fmt.Errorf("failed to commit transaction: %w", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return fmt.Sprintf("Success: user %s can read your email address", email), nil
+	return cmd.Message("Success: user %s can read your email address %s", email, granterEmail).
+		WithData(permissionData(granterEmail, email, true)), nil
 }
 
-func handleDeny(db *sql.DB, email, fingerprint string) (info string, err error) {
-	// TODO: handle cases with more than 1 mail per fingerprint
-	// Start transaction
-	err = mail.ValidateEmail(email)
+func handleDeny(db *sql.DB, email, as string, caller *cmd.Caller) (*cmd.Result, error) {
+	err := mail.ValidateEmail(email)
 	if err != nil {
-		return "", fmt.Errorf("mail address fails validation")
+		return nil, cmd.Errorf(cmd.CodeInvalidArgument, "mail address fails validation")
 	}
+	// Start transaction
 	tx, err := db.Begin()
 	if err != nil {
-		return "", fmt.Errorf("failed to begin transaction: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer func() {
 		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
@@ -153,28 +158,16 @@ func handleDeny(db *sql.DB, email, fingerprint string) (info string, err error)
 		}
 	}()
 
-	// Get the email of the user with the given fingerprint
-	var granterEmails []string
-	err = SELECT(table.SSHKeys.Email).
-		FROM(table.SSHKeys).
-		WHERE(table.SSHKeys.Fingerprint.EQ(String(fingerprint))).
-		Query(tx, &granterEmails)
-
-	if err != nil {
-		return "", fmt.Errorf("failed to query fingerprint owner: %w", err)
+	// Permissions are granted on behalf of the caller's primary email unless
+	// another one of their emails is given
+	granterEmails := caller.Emails
+	if slices.Contains(granterEmails, email) {
+		return nil, cmd.Errorf(cmd.CodeInvalidArgument, "you can't deny yourself.")
 	}
-	if len(granterEmails) == 0 {
-		return "", fmt.Errorf("no user found with fingerprint: %s", fingerprint)
-	}
-	for _, granterEmail := range granterEmails {
-		if granterEmail == email {
-			return "", fmt.Errorf("you can't deny yourself.")
-		}
-	}
-	if len(granterEmails) > 1 {
-		return "", fmt.Errorf("multiple users found with same fingerprint: %s", fingerprint)
+	granterEmail, err := selectGranterEmail(granterEmails, as)
+	if err != nil {
+		return nil, err
 	}
-	granterEmail := granterEmails[0]
 
 	// Delete the permission
 	result, err := table.EmailPermissions.DELETE().
@@ -187,22 +180,45 @@ func handleDeny(db *sql.DB, email, fingerprint string) (info string, err error)
 		Exec(tx)
 
 	if err != nil {
-		return "", fmt.Errorf("failed to delete permission: %w", err)
+		return nil, fmt.Errorf("failed to delete permission: %w", err)
 	}
 
 	// Check if any rows were affected
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return "", fmt.Errorf("failed to get rows affected: %w", err)
+		return nil, fmt.Errorf("failed to get rows affected: %w", err)
 	}
 	if rowsAffected == 0 {
-		return "", fmt.Errorf("no permission found for email: %s", email)
+		return nil, cmd.Errorf(cmd.CodeNotFound, "no permission found for email: %s", email)
+	}
+
+	_, err = translog.Append(tx, translog.Entry{
+		Op:          translog.OpDeny,
+		EmailHash:   translog.HashEmail(granterEmail),
+		Fingerprint: caller.Fingerprint,
+		GranteeHash: translog.HashEmail(email),
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// Commit transaction
 	if err = tx.Commit(); err != nil {
-		return "", fmt.Errorf("failed to commit transaction: %w", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return fmt.Sprintf("Success: user %s can no longer read your email address\n", email), nil
+	return cmd.Message("Success: user %s can no longer read your email address %s", email, granterEmail).
+		WithData(permissionData(granterEmail, email, false)), nil
+}
+
+// selectGranterEmail returns the email given with --as, which must be one of
+// the caller's emails, or the caller's primary email
+func selectGranterEmail(emails []string, as string) (string, error) {
+	if as == "" {
+		return emails[0], nil
+	}
+	if !slices.Contains(emails, as) {
+		return "", cmd.Errorf(cmd.CodeNotFound, "email is not registered to your key: %s", as)
+	}
+	return as, nil
 }
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	cmd "keypub/internal/command"
+	"keypub/internal/db/.gen/model"
+	"keypub/internal/db/.gen/table"
+	rl "keypub/internal/ratelimit"
+
+	. "github.com/go-jet/jet/v2/sqlite"
+)
+
+func registerCommandRateLimit(registry *cmd.CommandRegistry) *cmd.CommandRegistry {
+
+	registry.Register(cmd.Command{
+		Name:        "ratelimit",
+		Usage:       "ratelimit <subcommand>",
+		Description: "Inspect how close you are to the rate limit",
+		Category:    "Info",
+		Subcommands: map[string]cmd.Command{
+			"status": {
+				Name:        "status",
+				Usage:       "ratelimit status",
+				Description: "Show your current rate and the limit of every bucket you are charged against, for your key and your address",
+				Handler: func(ctx *cmd.CommandContext) (*cmd.Result, error) {
+					return handleRateLimitStatus(ctx, registry.Buckets())
+				},
+			},
+		},
+	})
+	return registry
+}
+
+// chargeRateLimits charges commands by remote address first, so denied
+// requests from fresh keys don't create fingerprint entries, then by
+// fingerprint. Each bucket is limited separately. Admin rules for the key or
+// address take precedence: blocked clients are refused, allowed ones are not
+// limited at all.
+func chargeRateLimits(ipRatelimit, ratelimit *rl.RateLimiter, rules *ruleCache) cmd.ChargeFunc {
+	return func(ctx *cmd.CommandContext, cost float64, bucket string) error {
+		action, err := rules.action(ctx.Fingerprint, ctx.RemoteAddr)
+		if err != nil {
+			return err
+		}
+		switch action {
+		case ruleBlock:
+			return cmd.Errorf(cmd.CodePermissionDenied, "requests from this key or address are blocked")
+		case ruleAllow:
+			return nil
+		}
+
+		res := ipRatelimit.Check(bucketClientID(bucket, rl.IPClientID(ctx.RemoteAddr)), cost)
+		if res.Allowed {
+			res = ratelimit.Check(bucketClientID(bucket, ctx.Fingerprint), cost)
+		}
+		if !res.Allowed {
+			return rateLimitedError(res)
+		}
+		return nil
+	}
+}
+
+// bucketClientID returns the limiter client ID of a client in a bucket
+func bucketClientID(bucket, clientID string) string {
+	if bucket == "" {
+		return clientID
+	}
+	return bucket + "/" + clientID
+}
+
+// rateLimitedError reports a denied request with the time until the next
+// request is allowed
+func rateLimitedError(res rl.Result) *cmd.Error {
+	retryAfter := time.Until(res.NextTime).Round(time.Second)
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	err := cmd.Errorf(cmd.CodeRateLimited, "Rate-limited, retry in %s", retryAfter)
+	err.RetryAfter = retryAfter
+	return err
+}
+
+// rateLimitBucket is the state of one rate limiter for the caller, in cost
+// units: a command costs 1 unless it says otherwise
+type rateLimitBucket struct {
+	Rate        float64 `json:"rate"`
+	Limit       float64 `json:"limit"`
+	Period      int64   `json:"period"` // Seconds
+	LastRequest string  `json:"last_request,omitempty"`
+}
+
+// rateLimitStatus is the JSON output of ratelimit status, the fingerprint
+// limit at the top level and the limit of the caller's address under ip.
+// Separate buckets, such as the one of commands sending mail, are listed by
+// name under buckets in the same form.
+type rateLimitStatus struct {
+	rateLimitBucket
+	IP      *rateLimitBucket           `json:"ip,omitempty"`
+	Buckets map[string]rateLimitStatus `json:"buckets,omitempty"`
+}
+
+// rateLimitState reads the state of the client from the limiter
+func rateLimitState(ratelimit *rl.RateLimiter, clientID string) rateLimitBucket {
+	bucket := rateLimitBucket{
+		Limit:  ratelimit.Limit(),
+		Period: int64(ratelimit.Period().Seconds()),
+	}
+
+	// The stored rate is from the last request, decay it to now the same way
+	// the limiter does before it adds the next request
+	rate, _ := ratelimit.GetRate(clientID)
+	if lastUpdate, ok := ratelimit.GetLastUpdate(clientID); ok {
+		elapsed := time.Since(lastUpdate).Seconds() / ratelimit.Period().Seconds()
+		bucket.Rate = rate * math.Exp(-elapsed)
+		bucket.LastRequest = lastUpdate.UTC().Format(time.RFC3339)
+	}
+	return bucket
+}
+
+func writeRateLimitState(result *strings.Builder, bucket rateLimitBucket, period time.Duration) {
+	result.WriteString(fmt.Sprintf("Rate: %.2f cost units per %s\n", bucket.Rate, period))
+	result.WriteString(fmt.Sprintf("Limit: %.2f cost units per %s\n", bucket.Limit, period))
+	if bucket.LastRequest != "" {
+		result.WriteString(fmt.Sprintf("Last request: %s\n", bucket.LastRequest))
+	}
+}
+
+// bucketStatus reads the state of the caller in one bucket, "" being the
+// shared one, and writes it to result
+func bucketStatus(ctx *cmd.CommandContext, bucket string, result *strings.Builder) rateLimitStatus {
+	suffix := ""
+	if bucket != "" {
+		suffix = fmt.Sprintf(", %s bucket", bucket)
+	}
+
+	status := rateLimitStatus{rateLimitBucket: rateLimitState(ctx.RateLimiter, bucketClientID(bucket, ctx.Fingerprint))}
+	result.WriteString(fmt.Sprintf("Key %s%s:\n", ctx.Fingerprint, suffix))
+	writeRateLimitState(result, status.rateLimitBucket, ctx.RateLimiter.Period())
+
+	if ctx.IPRateLimiter != nil && ctx.RemoteAddr != nil {
+		clientID := rl.IPClientID(ctx.RemoteAddr)
+		ipBucket := rateLimitState(ctx.IPRateLimiter, bucketClientID(bucket, clientID))
+		status.IP = &ipBucket
+		result.WriteString(fmt.Sprintf("\nAddress %s%s:\n", clientID, suffix))
+		writeRateLimitState(result, ipBucket, ctx.IPRateLimiter.Period())
+	}
+	return status
+}
+
+func handleRateLimitStatus(ctx *cmd.CommandContext, buckets []string) (*cmd.Result, error) {
+	if ctx.RateLimiter == nil {
+		return nil, fmt.Errorf("rate limiter not available")
+	}
+
+	var result strings.Builder
+	status := bucketStatus(ctx, "", &result)
+	for _, bucket := range buckets {
+		if status.Buckets == nil {
+			status.Buckets = map[string]rateLimitStatus{}
+		}
+		result.WriteString("\n")
+		status.Buckets[bucket] = bucketStatus(ctx, bucket, &result)
+	}
+
+	return &cmd.Result{Text: strings.TrimSuffix(result.String(), "\n"), Data: status}, nil
+}
+
+// Actions of rate limit rules
+const (
+	ruleAllow = "allow"
+	ruleBlock = "block"
+)
+
+// normalizeRuleTarget checks that a rule target is a key fingerprint, an IP
+// address or a CIDR range, and returns addresses as CIDR ranges
+func normalizeRuleTarget(target string) (string, error) {
+	if strings.HasPrefix(target, "SHA256:") {
+		return target, nil
+	}
+	if ip := net.ParseIP(target); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String(), nil
+	}
+	if _, prefix, err := net.ParseCIDR(target); err == nil {
+		return prefix.String(), nil
+	}
+	return "", cmd.Errorf(cmd.CodeInvalidArgument, "invalid target: %s, expected a SHA256 fingerprint, an IP address or a CIDR range", target)
+}
+
+// parsedRule is a rate limit rule ready to be matched
+type parsedRule struct {
+	fingerprint string     // Empty for address rules
+	prefix      *net.IPNet // Nil for key rules
+	action      string
+}
+
+// ruleCache keeps the parsed rules of a database in memory, as they are
+// checked on every command but only change with SetRateLimitRule and
+// RemoveRateLimitRule, which invalidate it
+type ruleCache struct {
+	db     *sql.DB
+	mu     sync.Mutex
+	rules  []parsedRule
+	loaded bool
+}
+
+func newRuleCache(db *sql.DB) *ruleCache {
+	return &ruleCache{db: db}
+}
+
+// get returns the rules, loading them on first use after an invalidation
+func (c *ruleCache) get() ([]parsedRule, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.loaded {
+		return c.rules, nil
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	var rules []struct {
+		Target string
+		Action string
+	}
+	err = SELECT(
+		table.RateLimitRules.Target.AS("target"),
+		table.RateLimitRules.Action.AS("action"),
+	).FROM(
+		table.RateLimitRules,
+	).Query(tx, &rules)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rate limit rules: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	parsed := make([]parsedRule, 0, len(rules))
+	for _, rule := range rules {
+		if _, prefix, err := net.ParseCIDR(rule.Target); err == nil {
+			parsed = append(parsed, parsedRule{prefix: prefix, action: rule.Action})
+		} else {
+			parsed = append(parsed, parsedRule{fingerprint: rule.Target, action: rule.Action})
+		}
+	}
+	c.rules, c.loaded = parsed, true
+	return c.rules, nil
+}
+
+// invalidate makes the next get load the rules again
+func (c *ruleCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules, c.loaded = nil, false
+}
+
+// action returns the action of the rules matching the fingerprint or the
+// remote address, "" if none does. Block wins over allow.
+func (c *ruleCache) action(fingerprint string, remoteAddr net.Addr) (string, error) {
+	rules, err := c.get()
+	if err != nil {
+		return "", err
+	}
+
+	var ip net.IP
+	if remoteAddr != nil {
+		ip = rl.RemoteIP(remoteAddr)
+	}
+
+	action := ""
+	for _, rule := range rules {
+		matches := rule.fingerprint != "" && rule.fingerprint == fingerprint
+		if rule.prefix != nil {
+			matches = ip != nil && rule.prefix.Contains(ip)
+		}
+		if !matches {
+			continue
+		}
+		if rule.action == ruleBlock {
+			return ruleBlock, nil
+		}
+		action = rule.action
+	}
+	return action, nil
+}
+
+// rateLimitRule is a rate limit rule in JSON output
+type rateLimitRule struct {
+	Target    string `json:"target"`
+	Action    string `json:"action"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt string `json:"created_at"`
+}
+
+// SetRateLimitRule allows or blocks the target, replacing any rule it had,
+// and invalidates the cached rules
+func SetRateLimitRule(db *sql.DB, rules *ruleCache, callerFingerprint, target, action string) (*cmd.Result, error) {
+	target, err := normalizeRuleTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	if action == ruleBlock && target == callerFingerprint {
+		return nil, cmd.Errorf(cmd.CodeConflict, "cannot block your own key")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	_, err = table.RateLimitRules.INSERT(
+		table.RateLimitRules.Target,
+		table.RateLimitRules.Action,
+		table.RateLimitRules.CreatedBy,
+	).VALUES(
+		String(target),
+		String(action),
+		String(callerFingerprint),
+	).ON_CONFLICT(table.RateLimitRules.Target).DO_UPDATE(
+		SET(
+			table.RateLimitRules.Action.SET(table.RateLimitRules.EXCLUDED.Action),
+			table.RateLimitRules.CreatedBy.SET(table.RateLimitRules.EXCLUDED.CreatedBy),
+			table.RateLimitRules.CreatedAt.SET(table.RateLimitRules.EXCLUDED.CreatedAt),
+		),
+	).Exec(tx)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to save rate limit rule: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	rules.invalidate()
+
+	verb := "allowed"
+	if action == ruleBlock {
+		verb = "blocked"
+	}
+	return &cmd.Result{
+		Text: fmt.Sprintf("%s is now %s", target, verb),
+		Data: map[string]string{"target": target, "action": action},
+	}, nil
+}
+
+// RemoveRateLimitRule removes the rule of the target, so it is limited
+// normally, and invalidates the cached rules
+func RemoveRateLimitRule(db *sql.DB, rules *ruleCache, target string) (*cmd.Result, error) {
+	target, err := normalizeRuleTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	result, err := table.RateLimitRules.
+		DELETE().
+		WHERE(table.RateLimitRules.Target.EQ(String(target))).
+		Exec(tx)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove rate limit rule: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return nil, cmd.Errorf(cmd.CodeNotFound, "no rate limit rule for %s", target)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	rules.invalidate()
+
+	return &cmd.Result{
+		Text: fmt.Sprintf("Rate limit rule for %s removed", target),
+		Data: map[string]string{"target": target},
+	}, nil
+}
+
+// ListRateLimitRules lists the rules, optionally only those of one target
+func ListRateLimitRules(db *sql.DB, target string) (*cmd.Result, error) {
+	condition := Bool(true)
+	if target != "" {
+		normalized, err := normalizeRuleTarget(target)
+		if err != nil {
+			return nil, err
+		}
+		condition = table.RateLimitRules.Target.EQ(String(normalized))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	var rules []model.RateLimitRules
+	err = SELECT(
+		table.RateLimitRules.AllColumns,
+	).FROM(
+		table.RateLimitRules,
+	).WHERE(
+		condition,
+	).ORDER_BY(
+		table.RateLimitRules.Action.ASC(),
+		table.RateLimitRules.CreatedAt.ASC(),
+	).Query(tx, &rules)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rate limit rules: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if len(rules) == 0 {
+		return &cmd.Result{
+			Text: "No rate limit rules",
+			Data: map[string][]rateLimitRule{"rules": {}},
+		}, nil
+	}
+
+	var output strings.Builder
+	data := []rateLimitRule{}
+	output.WriteString("Rate limit rules:\n")
+	for _, rule := range rules {
+		createdAt := time.Unix(int64(rule.CreatedAt), 0).Format(time.RFC3339)
+		data = append(data, rateLimitRule{
+			Target:    rule.Target,
+			Action:    rule.Action,
+			CreatedBy: rule.CreatedBy,
+			CreatedAt: createdAt,
+		})
+		output.WriteString(fmt.Sprintf("- %s %s (added %s by %s)\n", rule.Action, rule.Target, createdAt, rule.CreatedBy))
+	}
+
+	return &cmd.Result{
+		Text: strings.TrimSuffix(output.String(), "\n"),
+		Data: map[string][]rateLimitRule{"rules": data},
+	}, nil
+}
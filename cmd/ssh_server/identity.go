@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	cmd "keypub/internal/command"
+	"keypub/internal/db/.gen/table"
+
+	. "github.com/go-jet/jet/v2/sqlite"
+)
+
+// callerIdentity resolves the emails, the admin role and the language of the
+// caller, and reports whether a registration of the key lacks its public key
+func callerIdentity(db *sql.DB, fingerprint string) (*cmd.Caller, bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	emails, err := fingerprintEmails(tx, fingerprint)
+	if err != nil {
+		return nil, false, err
+	}
+	role, err := adminRole(tx, fingerprint)
+	if err != nil {
+		return nil, false, err
+	}
+	lang, err := preferredLang(tx, fingerprint)
+	if err != nil {
+		return nil, false, err
+	}
+	missingKey, err := missingPublicKey(tx, fingerprint)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &cmd.Caller{Fingerprint: fingerprint, Emails: emails, Role: role, Lang: lang}, missingKey, nil
+}
+
+// missingPublicKey reports whether a registration of the fingerprint was
+// made before public keys were stored
+func missingPublicKey(tx *sql.Tx, fingerprint string) (bool, error) {
+	var count []int64
+	err := SELECT(COUNT(table.SSHKeys.Fingerprint)).
+		FROM(table.SSHKeys).
+		WHERE(
+			AND(
+				table.SSHKeys.Fingerprint.EQ(String(fingerprint)),
+				table.SSHKeys.PublicKey.IS_NULL(),
+			),
+		).
+		Query(tx, &count)
+
+	if err != nil {
+		return false, fmt.Errorf("failed to query stored public key: %w", err)
+	}
+	if len(count) != 1 {
+		return false, fmt.Errorf("invalid count result")
+	}
+	return count[0] > 0, nil
+}
+
+// preferredLang returns the language set for the fingerprint, "" if none
+func preferredLang(tx *sql.Tx, fingerprint string) (string, error) {
+	var langs []string
+	err := SELECT(table.KeyPreferences.Lang).
+		FROM(table.KeyPreferences).
+		WHERE(table.KeyPreferences.Fingerprint.EQ(String(fingerprint))).
+		Query(tx, &langs)
+
+	if err != nil {
+		return "", fmt.Errorf("failed to query preferred language: %w", err)
+	}
+	if len(langs) == 0 {
+		return "", nil
+	}
+	return langs[0], nil
+}
+
+// adminRole returns the role of the fingerprint, "" if it is not an admin
+func adminRole(tx *sql.Tx, fingerprint string) (string, error) {
+	var roles []string
+	err := SELECT(table.AdminFingerprints.Role).
+		FROM(table.AdminFingerprints).
+		WHERE(table.AdminFingerprints.Fingerprint.EQ(String(fingerprint))).
+		Query(tx, &roles)
+
+	if err != nil {
+		return "", fmt.Errorf("failed to query admin role: %w", err)
+	}
+	if len(roles) == 0 {
+		return "", nil
+	}
+	return roles[0], nil
+}
+
+// fingerprintEmails returns the verified emails of the fingerprint, primary first
+func fingerprintEmails(tx *sql.Tx, fingerprint string) ([]string, error) {
+	var emails []string
+	err := SELECT(table.SSHKeys.Email).
+		FROM(table.SSHKeys).
+		WHERE(table.SSHKeys.Fingerprint.EQ(String(fingerprint))).
+		ORDER_BY(
+			table.SSHKeys.IsPrimary.DESC(),
+			table.SSHKeys.CreatedAt.ASC(),
+		).
+		Query(tx, &emails)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query emails for fingerprint: %w", err)
+	}
+	return emails, nil
+}
+
+// hasPermission reports whether the granter email allowed any of the grantee emails
+func hasPermission(tx *sql.Tx, granterEmail string, granteeEmails []string) (bool, error) {
+	if len(granteeEmails) == 0 {
+		return false, nil
+	}
+	grantees := make([]Expression, len(granteeEmails))
+	for i, email := range granteeEmails {
+		grantees[i] = String(email)
+	}
+
+	var permissionCount []int64
+	err := SELECT(COUNT(table.EmailPermissions.GranterEmail)).
+		FROM(table.EmailPermissions).
+		WHERE(
+			AND(
+				table.EmailPermissions.GranterEmail.EQ(String(granterEmail)),
+				table.EmailPermissions.GranteeEmail.IN(grantees...),
+			),
+		).
+		Query(tx, &permissionCount)
+
+	if err != nil {
+		return false, fmt.Errorf("failed to query permissions: %w", err)
+	}
+	if len(permissionCount) != 1 {
+		return false, fmt.Errorf("failed to count permissions")
+	}
+	return permissionCount[0] > 0, nil
+}
+
+// isBanned reports whether the fingerprint or email was banned by an admin
+func isBanned(tx *sql.Tx, target string) (bool, error) {
+	var count []int64
+	err := SELECT(COUNT(table.Bans.Target)).
+		FROM(table.Bans).
+		WHERE(table.Bans.Target.EQ(String(target))).
+		Query(tx, &count)
+
+	if err != nil {
+		return false, fmt.Errorf("failed to query bans: %w", err)
+	}
+	if len(count) != 1 {
+		return false, fmt.Errorf("invalid count result")
+	}
+	return count[0] > 0, nil
+}
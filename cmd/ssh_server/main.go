@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gliderlabs/ssh"
 	gossh "golang.org/x/crypto/ssh"
@@ -19,9 +24,16 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 
 	db_utils "keypub/internal/db"
+	"keypub/internal/translog"
 )
 
 func main() {
+	// Registered first so it runs after all other deferred cleanups
+	exitCode := 0
+	defer func() {
+		os.Exit(exitCode)
+	}()
+
 	// Load configuration
 	result, err := config.LoadFromFlags()
 	if err != nil {
@@ -33,58 +45,111 @@ func main() {
 	cfg := result.Config
 	log.Printf("Starting server with %s", result.Source)
 
-	// initialize rate limiter
-	ratelimit := rl.NewRateLimiter(cfg.RateLimit.Limit, cfg.RateLimit.Duration, cfg.RateLimit.Strict)
-	defer ratelimit.Stop()
-
 	// initialize server
 	hostKey, err := loadHostKey(cfg.Server.HostKey, cfg.Server.HostKeyPassphrase)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// open DB
+	db, err := db_utils.NewDB(cfg.Database.Path)
+	if err != nil {
+		log.Fatalf("Cannot open db file: %s", err)
+	}
+	defer db.Close()
+
+	if err := db_utils.Migrate(db); err != nil {
+		log.Fatalf("Cannot migrate db: %s", err)
+	}
+	if err := translog.BackfillFrontiers(db); err != nil {
+		log.Fatalf("Cannot backfill transparency log: %s", err)
+	}
+
+	if err := BootstrapAdmins(db, cfg.Server.BootstrapAdmins); err != nil {
+		log.Fatalf("Cannot bootstrap admins: %s", err)
+	}
+
 	server := ssh.Server{
 		Addr:        fmt.Sprintf(":%d", cfg.Server.Port),
 		HostSigners: []ssh.Signer{hostKey},
 		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
-			return true
+			// Any key may connect, except those banned by an admin
+			fingerprint := gossh.FingerprintSHA256(key)
+			banned, err := IsBanned(db, fingerprint)
+			if err != nil {
+				log.Printf("Error checking ban of %s: %v", fingerprint, err)
+				return false
+			}
+			return !banned
 		},
 	}
 
-	// open DB
-	db, err := db_utils.NewDB(cfg.Database.Path)
-	if err != nil {
-		log.Fatalf("Cannot open db file: %s", err)
-	}
-	defer db.Close()
+	// initialize rate limiters, per fingerprint and per remote IP since
+	// fresh keys cost nothing. Their state is kept in the DB across restarts.
+	ratelimit := rl.NewRateLimiter(cfg.RateLimit.Limit, cfg.RateLimit.Duration, cfg.RateLimit.Strict,
+		db_utils.NewRateLimitStore(db, "fingerprint"))
+	defer ratelimit.Stop()
+	ipRatelimit := rl.NewRateLimiter(cfg.RateLimit.IP.Limit, cfg.RateLimit.IP.Duration, cfg.RateLimit.IP.Strict,
+		db_utils.NewRateLimitStore(db, "ip"))
+	defer ipRatelimit.Stop()
 
 	// regular interval DB cleaner (currently only for verification codes)
 	verification_cleaner := db_utils.NewVerificationCleaner(db, cfg.Verification.Duration)
 	defer verification_cleaner.Close()
 
 	// initialize mail sender
+	templates, err := mail.LoadTemplates(cfg.Email.TemplateDir, cfg.Server.Hostname)
+	if err != nil {
+		log.Fatalf("Could not load mail templates: %s", err)
+	}
 	var mail_sender mail.MailSender
 	switch cfg.Email.EmailService {
 	case "resend":
-		mail_sender, err = mail.NewResendMailSender(cfg.Email.Resend.ResendKeyPath, cfg.Email.FromEmail, cfg.Email.FromName)
+		mail_sender, err = mail.NewResendMailSender(cfg.Email.Resend.ResendKeyPath, cfg.Email.FromEmail, cfg.Email.FromName, templates)
 		if err != nil {
 			log.Fatalf("Could not initialize ResendMailSender: %s", err)
 		}
 	case "smtp":
-		mail_sender = mail.NewSMTPMailSender(
-			cfg.Email.SMTP.Host,
-			cfg.Email.SMTP.Port,
-			cfg.Email.SMTP.Username,
-			cfg.Email.SMTP.Password,
-			cfg.Email.SMTP.Secure,
-			cfg.Email.FromEmail,
-			cfg.Email.FromName,
-		)
+		// Configs from before tls keep what secure meant then
+		tlsMode := cfg.Email.SMTP.TLS
+		if tlsMode == "" {
+			tlsMode = mail.SMTPTLSOpportunistic
+			if cfg.Email.SMTP.Secure {
+				tlsMode = mail.SMTPTLSImplicit
+			}
+			log.Printf("smtp tls is not set, using %s; set it explicitly, secure is deprecated", tlsMode)
+		}
+		var dkim *mail.DKIMSigner
+		if cfg.Email.SMTP.DKIM.KeyPath != "" {
+			dkim, err = newDKIMSigner(cfg)
+			if err != nil {
+				log.Fatalf("Could not initialize DKIM signing: %s", err)
+			}
+		}
+		mail_sender, err = mail.NewSMTPMailSender(mail.SMTPOptions{
+			Host:           cfg.Email.SMTP.Host,
+			Port:           cfg.Email.SMTP.Port,
+			Username:       cfg.Email.SMTP.Username,
+			Password:       cfg.Email.SMTP.Password,
+			TLS:            tlsMode,
+			Auth:           cfg.Email.SMTP.Auth,
+			ConnectTimeout: cfg.Email.SMTP.ConnectTimeout,
+			Timeout:        cfg.Email.SMTP.Timeout,
+			DKIM:           dkim,
+		}, cfg.Email.FromEmail, cfg.Email.FromName, templates)
+		if err != nil {
+			log.Fatalf("Could not initialize SMTPMailSender: %s", err)
+		}
 	default:
 		log.Fatalf("Invalid email_serivce option")
 		return
 	}
 
+	// Mails are stored and sent in the background, retrying failures
+	// A confirmation mail arriving after its code expired is of no use
+	outbox := mail.NewOutbox(mail_sender, db_utils.NewOutboxStore(db), templates, cfg.Verification.Duration)
+	defer outbox.Stop()
+
 	// Only initialize backup if enabled
 	if cfg.Backup.Enabled {
 		bm, err := initializeBackup(cfg, db)
@@ -96,43 +161,100 @@ func main() {
 	}
 
 	// Initialize command registry
+	rules := newRuleCache(db)
 	cmdRegistry := cmd.NewCommandRegistry()
 	registerCommandInfo(cmdRegistry)
 	registerCommandAccount(cmdRegistry)
 	registerCommandRegistration(cmdRegistry)
-	registerCommandAdmin(cmdRegistry)
+	registerCommandAdmin(cmdRegistry, rules)
 	registerCommandLookup(cmdRegistry)
+	registerCommandLog(cmdRegistry)
+	registerCommandRateLimit(cmdRegistry)
+	for _, limiter := range []*rl.RateLimiter{ratelimit, ipRatelimit} {
+		if err := cmdRegistry.CheckCosts(limiter.Limit()); err != nil {
+			log.Fatalf("Rate limit too low: %s", err)
+		}
+	}
+	cmdRegistry.SetChargeFunc(chargeRateLimits(ipRatelimit, ratelimit, rules))
+	cmdRegistry.SetIdentityFunc(func(ctx *cmd.CommandContext) (*cmd.Caller, error) {
+		caller, missingKey, err := callerIdentity(ctx.DB, ctx.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+
+		// Store the full key for registrations made before keys were persisted
+		if missingKey && ctx.PublicKey != nil {
+			if err := backfillPublicKey(ctx.DB, ctx.PublicKey); err != nil {
+				log.Printf("Error backfilling key for %s: %v", ctx.Fingerprint, err)
+			}
+		}
+		return caller, nil
+	})
+	cmdRegistry.Use(cmd.Timing(time.Second), cmd.Audit)
 
 	// Handle SSH sessions
 	server.Handle(func(s ssh.Session) {
 		fingerprint := gossh.FingerprintSHA256(s.PublicKey())
 
-		// Rate limiting check
-		rl_res := ratelimit.Check(fingerprint)
-		if !rl_res.Allowed {
-			_, _ = io.WriteString(s, "Error: Rate-limited\n")
-			return
-		}
-
 		// Create command context
 		ctx := &cmd.CommandContext{
-			DB:          db,
-			Args:        s.Command(),
-			Fingerprint: fingerprint,
-			MailSender:  mail_sender,
-			Server:      &server,
+			DB:            db,
+			Args:          s.Command(),
+			Fingerprint:   fingerprint,
+			PublicKey:     s.PublicKey(),
+			MailSender:    outbox,
+			RateLimiter:   ratelimit,
+			IPRateLimiter: ipRatelimit,
+			RemoteAddr:    s.RemoteAddr(),
+			HostSigner:    hostKey,
+			Server:        &server,
 		}
 
-		// Execute command
-		if info, err := cmdRegistry.Execute(ctx); err != nil {
-			_, _ = io.WriteString(s, fmt.Sprintf("Error: %s\n", err))
-		} else {
-			_, _ = io.WriteString(s, fmt.Sprintf("%s\n", info))
+		// Execute command, failures are already rendered into the output
+		// and go to stderr with an exit status telling them apart
+		output, err := cmdRegistry.Execute(ctx)
+		if err != nil {
+			if cmd.ErrorCode(err) == cmd.CodeInternal {
+				log.Printf("Error running command for %s: %v", fingerprint, err)
+			}
+			_, _ = io.WriteString(s.Stderr(), output+"\n")
+			_ = s.Exit(cmd.ExitStatus(err))
+			return
 		}
+		_, _ = io.WriteString(s, output+"\n")
 	})
 
+	// Shut down gracefully on SIGINT and SIGTERM like on the shutdown command
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Received %s, shutting down...", sig)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error during shutdown: %v", err)
+		}
+	}()
+
 	log.Printf("Starting SSH server on port %d...", cfg.Server.Port)
-	log.Fatal(server.ListenAndServe())
+
+	// Return instead of exiting, so the deferred cleanups save their state
+	if err := server.ListenAndServe(); !errors.Is(err, ssh.ErrServerClosed) {
+		log.Printf("Server error: %v", err)
+		exitCode = 1
+		return
+	}
+
+	// ListenAndServe returns as soon as shutdown starts, wait for the
+	// sessions still running before the DB is closed
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error waiting for sessions: %v", err)
+	}
+	log.Printf("Server stopped")
 }
 
 func initializeBackup(cfg *config.Config, db *sql.DB) (*db_utils.BackupManager, error) {
@@ -164,3 +286,24 @@ func initializeBackup(cfg *config.Config, db *sql.DB) (*db_utils.BackupManager,
 		BackupLabel:    cfg.Backup.Label,
 	})
 }
+
+// newDKIMSigner loads the DKIM key and logs the DNS record to publish for it
+func newDKIMSigner(cfg *config.Config) (*mail.DKIMSigner, error) {
+	domain := cfg.Email.SMTP.DKIM.Domain
+	if domain == "" {
+		if at := strings.LastIndex(cfg.Email.FromEmail, "@"); at >= 0 {
+			domain = cfg.Email.FromEmail[at+1:]
+		}
+	}
+
+	signer, err := mail.NewDKIMSigner(domain, cfg.Email.SMTP.DKIM.Selector, cfg.Email.SMTP.DKIM.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	name, record, err := signer.DNSRecord()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Signing mails with DKIM, the public key goes in the TXT record %s: %s", name, record)
+	return signer, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/dsa" //nolint:staticcheck // still needed to size legacy ssh-dss keys
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"keypub/internal/db/.gen/table"
+
+	"github.com/gliderlabs/ssh"
+	. "github.com/go-jet/jet/v2/sqlite"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// authorizedKey returns the key in authorized_keys format, without comment or trailing newline
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key)))
+}
+
+// keyBits returns the size of the key in bits, or 0 if it cannot be determined
+func keyBits(key ssh.PublicKey) int {
+	if cert, ok := key.(*gossh.Certificate); ok {
+		key = cert.Key
+	}
+	cryptoKey, ok := key.(gossh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+
+	switch k := cryptoKey.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return 256
+	case *dsa.PublicKey:
+		return k.P.BitLen()
+	default:
+		return 0
+	}
+}
+
+// backfillPublicKey stores the full public key on registrations that were
+// created before keys were persisted. Callers only run it when callerIdentity
+// reports a missing key, as it takes the write lock even if nothing matches.
+func backfillPublicKey(db *sql.DB, key ssh.PublicKey) error {
+	fingerprint := gossh.FingerprintSHA256(key)
+
+	_, err := table.SSHKeys.UPDATE(
+		table.SSHKeys.PublicKey,
+		table.SSHKeys.KeyType,
+		table.SSHKeys.KeyBits,
+	).SET(
+		authorizedKey(key),
+		key.Type(),
+		keyBits(key),
+	).WHERE(
+		AND(
+			table.SSHKeys.Fingerprint.EQ(String(fingerprint)),
+			table.SSHKeys.PublicKey.IS_NULL(),
+		),
+	).Exec(db)
+	if err != nil {
+		return fmt.Errorf("failed to backfill public key: %w", err)
+	}
+
+	return nil
+}
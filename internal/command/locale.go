@@ -0,0 +1,32 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+
+	"keypub/internal/i18n"
+)
+
+// localize translates the text of a result or the message of an error to
+// lang. Messages built with Message and Errorf are translated by their
+// format, other result texts only if they are in the catalog as a whole.
+func localize(lang string, result *Result, err error) (*Result, error) {
+	if result != nil {
+		translated := *result
+		if result.format != "" {
+			translated.Text = i18n.Sprintf(lang, result.format, result.args...)
+		} else {
+			translated.Text = i18n.T(lang, result.Text)
+		}
+		result = &translated
+	}
+
+	var cmdErr *Error
+	if errors.As(err, &cmdErr) && cmdErr.format != "" {
+		translated := *cmdErr
+		// Formatted like Errorf, args may include a wrapped error
+		translated.Message = fmt.Errorf(i18n.T(lang, cmdErr.format), cmdErr.args...).Error()
+		err = &translated
+	}
+	return result, err
+}
@@ -0,0 +1,90 @@
+package command
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// Middleware wraps the handler of a command, to check requirements before it
+// runs or to observe its outcome
+type Middleware func(next CommandHandlerFunc) CommandHandlerFunc
+
+// Caller is the identity of whoever runs a command, resolved before any
+// middleware runs
+type Caller struct {
+	Fingerprint string
+	Emails      []string // Verified emails, primary first, none if not registered
+	Role        string   // Admin role, "" if not an admin
+	Lang        string   // Preferred language, "" for the default
+}
+
+// Registered reports whether the caller has at least one verified email
+func (c *Caller) Registered() bool {
+	return c != nil && len(c.Emails) > 0
+}
+
+// IdentityFunc resolves the identity of the caller of a command
+type IdentityFunc func(ctx *CommandContext) (*Caller, error)
+
+// RequireRegistered refuses callers without a verified email
+func RequireRegistered(next CommandHandlerFunc) CommandHandlerFunc {
+	return func(ctx *CommandContext) (*Result, error) {
+		if !ctx.Caller.Registered() {
+			return nil, Errorf(CodePermissionDenied, "caller not registered")
+		}
+		return next(ctx)
+	}
+}
+
+// RequireRole refuses callers without the given admin role or a higher one
+func RequireRole(role string) Middleware {
+	return func(next CommandHandlerFunc) CommandHandlerFunc {
+		return func(ctx *CommandContext) (*Result, error) {
+			callerRole := ""
+			if ctx.Caller != nil {
+				callerRole = ctx.Caller.Role
+			}
+			if !HasRole(callerRole, role) {
+				return nil, Errorf(CodePermissionDenied, "unauthorized: %s requires the %s role", ctx.Command.path(), role)
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// Audit logs every run of a command that requires an admin role, with the
+// caller and the outcome, including refused attempts
+func Audit(next CommandHandlerFunc) CommandHandlerFunc {
+	return func(ctx *CommandContext) (*Result, error) {
+		result, err := next(ctx)
+		if ctx.Command.Role == "" {
+			return result, err
+		}
+
+		role := "none"
+		if ctx.Caller != nil && ctx.Caller.Role != "" {
+			role = ctx.Caller.Role
+		}
+		outcome := "ok"
+		if err != nil {
+			outcome = ErrorCode(err)
+		}
+		log.Printf("audit: %s (%s) ran %q: %s", ctx.Fingerprint, role, strings.Join(ctx.Args, " "), outcome)
+		return result, err
+	}
+}
+
+// Timing logs commands that take longer than slow
+func Timing(slow time.Duration) Middleware {
+	return func(next CommandHandlerFunc) CommandHandlerFunc {
+		return func(ctx *CommandContext) (*Result, error) {
+			start := time.Now()
+			result, err := next(ctx)
+			if elapsed := time.Since(start); elapsed > slow {
+				log.Printf("slow command: %s took %s", ctx.Command.path(), elapsed.Round(time.Millisecond))
+			}
+			return result, err
+		}
+	}
+}
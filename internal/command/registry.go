@@ -2,12 +2,15 @@ package command
 
 import (
 	"database/sql"
-	"errors"
 	"fmt"
+	"net"
+	"slices"
 	"sort"
 	"strings"
 
+	"keypub/internal/i18n"
 	"keypub/internal/mail"
+	"keypub/internal/ratelimit"
 
 	"github.com/gliderlabs/ssh"
 )
@@ -20,23 +23,63 @@ type Command struct {
 	Category    string
 	Handler     CommandHandlerFunc
 	Subcommands map[string]Command // For commands that have subcommands
+
+	// Cost is charged against the caller's rate limit, ratelimit.DefaultCost
+	// if zero. Commands with a Bucket are limited separately from the rest.
+	Cost   float64
+	Bucket string
+
+	// Role is the admin role required to run the command, none if empty.
+	// Subcommands without a role inherit the role of their parent.
+	Role string
+
+	// Middleware runs around the handler, after the role check. Subcommands
+	// run the middleware of their parent first.
+	Middleware []Middleware
+
+	spec *usageSpec // Parsed Usage, set by Register
 }
 
 // CommandHandlerFunc is the function signature for command handlers
-type CommandHandlerFunc func(ctx *CommandContext) (string, error)
+type CommandHandlerFunc func(ctx *CommandContext) (*Result, error)
 
 // CommandContext holds all the context needed for command execution
 type CommandContext struct {
-	DB          *sql.DB
-	Args        []string
-	Fingerprint string
-	MailSender  mail.MailSender
-	Server      *ssh.Server // Optional, needed for shutdown command
+	DB            *sql.DB
+	Args          []string
+	Params        Params // Args parsed according to the command's usage
+	Fingerprint   string
+	PublicKey     ssh.PublicKey
+	MailSender    mail.MailSender
+	RateLimiter   *ratelimit.RateLimiter // Per fingerprint
+	IPRateLimiter *ratelimit.RateLimiter // Per remote IP
+	RemoteAddr    net.Addr
+	HostSigner    ssh.Signer  // Signs transparency log tree heads
+	Server        *ssh.Server // Optional, needed for shutdown command
+
+	// Set by the registry before the handler runs
+	Command *Command // The resolved command or subcommand
+	Caller  *Caller  // Nil if no identity function is set
+}
+
+// Lang returns the preferred language of the caller, "" for the default
+func (ctx *CommandContext) Lang() string {
+	if ctx.Caller == nil {
+		return ""
+	}
+	return ctx.Caller.Lang
 }
 
+// ChargeFunc charges the caller of a command against the rate limits of the
+// given bucket, "" being the shared one. It returns an error to deny the request.
+type ChargeFunc func(ctx *CommandContext, cost float64, bucket string) error
+
 // CommandRegistry manages all available commands
 type CommandRegistry struct {
-	commands map[string]Command
+	commands   map[string]Command
+	charge     ChargeFunc
+	identify   IdentityFunc
+	middleware []Middleware
 }
 
 func NewCommandRegistry() *CommandRegistry {
@@ -45,74 +88,289 @@ func NewCommandRegistry() *CommandRegistry {
 	}
 }
 
+// SetChargeFunc sets the function that rate limits commands before they run
+func (r *CommandRegistry) SetChargeFunc(charge ChargeFunc) {
+	r.charge = charge
+}
+
+// SetIdentityFunc sets the function that resolves the caller of commands,
+// once they got past the charge function
+func (r *CommandRegistry) SetIdentityFunc(identify IdentityFunc) {
+	r.identify = identify
+}
+
+// Use adds middleware that runs around every command, outermost first
+func (r *CommandRegistry) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Register adds a command. It panics if the usage or the role of the command
+// or of one of its subcommands is malformed.
 func (r *CommandRegistry) Register(cmd Command) {
-	r.commands[cmd.Name] = cmd
+	r.commands[cmd.Name] = prepareCommand(cmd)
 }
 
-// getRequiredArgsCount returns the number of required arguments based on the usage string
-func getRequiredArgsCount(usage string) int {
-	parts := strings.Fields(usage)
-	count := 0
-	for _, part := range parts[1:] { // Skip the command name
-		if strings.HasPrefix(part, "<") && strings.HasSuffix(part, ">") {
-			count++
+// prepareCommand parses the usage of the command and of its subcommands,
+// which may have subcommands of their own, and passes its role and
+// middleware down
+func prepareCommand(cmd Command) Command {
+	cmd.spec = parseUsage(cmd.Usage)
+	if cmd.Role != "" && !ValidRole(cmd.Role) {
+		panic(fmt.Sprintf("command %q: unknown role %q", cmd.Usage, cmd.Role))
+	}
+	if len(cmd.Subcommands) > 0 {
+		subcommands := make(map[string]Command, len(cmd.Subcommands))
+		for name, subcmd := range cmd.Subcommands {
+			if subcmd.Role == "" {
+				subcmd.Role = cmd.Role
+			}
+			subcmd.Middleware = append(slices.Clone(cmd.Middleware), subcmd.Middleware...)
+			subcommands[name] = prepareCommand(subcmd)
 		}
+		cmd.Subcommands = subcommands
 	}
-	return count
+	return cmd
 }
 
-// Execute runs the specified command with given context
+// Execute runs the specified command with given context and renders its
+// output as text, or as JSON if --json or -o json is given. Text output is
+// in the language of the caller, JSON output stays in English for scripts.
+// The returned error is an *Error describing the failure, its message is
+// already part of the output.
 func (r *CommandRegistry) Execute(ctx *CommandContext) (string, error) {
-	if len(ctx.Args) == 0 {
-		return "", errors.New(r.GetHelpText())
+	// Output options among free text, such as a ban reason, are text
+	end := r.freeText(ctx.Args)
+	format, args, err := OutputFormat(ctx.Args[:end])
+	if err != nil {
+		return Render(FormatText, nil, err)
 	}
+	ctx.Args = append(args, ctx.Args[end:]...)
 
-	cmd, exists := r.commands[ctx.Args[0]]
-	if !exists {
-		return "", fmt.Errorf("unknown command: %s\n\n%s", ctx.Args[0], r.GetHelpText())
+	result, err := r.execute(ctx)
+	if format == FormatText {
+		result, err = localize(ctx.Lang(), result, err)
 	}
+	return Render(format, result, err)
+}
 
-	// Handle subcommands if they exist
-	if len(cmd.Subcommands) > 0 {
-		return r.executeSubcommand(ctx, cmd)
+func (r *CommandRegistry) execute(ctx *CommandContext) (*Result, error) {
+	cmd, params, err := r.prepare(ctx.Args, "")
+
+	// Charge once the command is known and before the caller is looked up,
+	// so throttled and blocked clients cost nothing more than the check.
+	// Requests that fail before running anything cost the default.
+	if r.charge != nil {
+		cost, bucket := ratelimit.DefaultCost, ""
+		if err == nil {
+			cost, bucket = cmd.cost(), cmd.Bucket
+		}
+		if chargeErr := r.charge(ctx, cost, bucket); chargeErr != nil {
+			return nil, chargeErr
+		}
 	}
 
-	// Regular command without subcommands
-	argsCount := len(ctx.Args) - 1 // Subtract command name
-	expectedArgs := getRequiredArgsCount(cmd.Usage)
-	if argsCount != expectedArgs {
-		return "", fmt.Errorf("Usage: %s", cmd.Usage)
+	if r.identify != nil {
+		caller, identifyErr := r.identify(ctx)
+		if identifyErr != nil {
+			return nil, identifyErr
+		}
+		ctx.Caller = caller
+	}
+	if err != nil {
+		// Again with the help in the language of the caller
+		if lang := ctx.Lang(); lang != "" {
+			_, _, err = r.prepare(ctx.Args, lang)
+		}
+		return nil, err
 	}
 
-	return cmd.Handler(ctx)
+	ctx.Params = params
+	ctx.Command = &cmd
+	return r.chain(cmd)(ctx)
 }
 
-// executeSubcommand handles execution of commands with subcommands
-func (r *CommandRegistry) executeSubcommand(ctx *CommandContext, cmd Command) (string, error) {
-	if len(ctx.Args) < 2 {
-		return "", errors.New(r.getSubcommandHelp(cmd))
+// prepare resolves the command named by args and parses its arguments.
+// Usage errors come with help in lang.
+func (r *CommandRegistry) prepare(args []string, lang string) (Command, Params, error) {
+	cmd, args, err := r.resolve(args, lang)
+	if err != nil {
+		return Command{}, nil, err
 	}
 
-	subcmd, exists := cmd.Subcommands[ctx.Args[1]]
+	params, usageErr := cmd.spec.parse(args)
+	if usageErr != nil {
+		usageErr.Detail = i18n.Sprintf(lang, "Usage: %s", cmd.spec)
+		return Command{}, nil, usageErr
+	}
+	return cmd, params, nil
+}
+
+// chain wraps the handler of the command in the middleware of the registry,
+// the role check and the middleware of the command, outermost first
+func (r *CommandRegistry) chain(cmd Command) CommandHandlerFunc {
+	middleware := slices.Clone(r.middleware)
+	if cmd.Role != "" {
+		middleware = append(middleware, RequireRole(cmd.Role))
+	}
+	middleware = append(middleware, cmd.Middleware...)
+
+	handler := cmd.Handler
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// resolve finds the command or subcommand named by args, and returns it with
+// the arguments that follow its name. Usage errors come with help in lang.
+func (r *CommandRegistry) resolve(args []string, lang string) (Command, []string, error) {
+	if len(args) == 0 {
+		err := Errorf(CodeUsage, "no command given")
+		err.Detail = r.GetHelpText(lang)
+		return Command{}, nil, err
+	}
+
+	cmd, exists := r.commands[args[0]]
 	if !exists {
-		return "", fmt.Errorf("unknown %s subcommand: %s\n\n%s",
-			cmd.Name, ctx.Args[1], r.getSubcommandHelp(cmd))
+		err := Errorf(CodeUsage, "unknown command: %s", args[0])
+		err.Detail = r.GetHelpText(lang)
+		return Command{}, nil, err
 	}
+	args = args[1:]
+
+	// Handle subcommands if they exist, at any depth
+	for len(cmd.Subcommands) > 0 {
+		if len(args) == 0 {
+			err := Errorf(CodeUsage, "missing %s subcommand", cmd.path())
+			err.Detail = r.getSubcommandHelp(cmd, lang)
+			return Command{}, nil, err
+		}
 
-	argsCount := len(ctx.Args) - 2 // Subtract command and subcommand
-	expectedArgs := getRequiredArgsCount(subcmd.Usage)
-	if argsCount != expectedArgs {
-		return "", fmt.Errorf("Usage: %s", subcmd.Usage)
+		subcmd, exists := cmd.Subcommands[args[0]]
+		if !exists {
+			err := Errorf(CodeUsage, "unknown %s subcommand: %s", cmd.path(), args[0])
+			err.Detail = r.getSubcommandHelp(cmd, lang)
+			return Command{}, nil, err
+		}
+		cmd, args = subcmd, args[1:]
 	}
 
-	return subcmd.Handler(ctx)
+	return cmd, args, nil
 }
 
-// getSubcommandHelp returns help text for a command's subcommands
-func (r *CommandRegistry) getSubcommandHelp(cmd Command) string {
-	var help strings.Builder
-	help.WriteString(fmt.Sprintf("Available %s subcommands:\n\n", cmd.Name))
+// CheckCosts returns an error if a command costs more than limit, as a
+// rate limiter with that limit would never let it run
+func (r *CommandRegistry) CheckCosts(limit float64) error {
+	var check func(commands map[string]Command) error
+	check = func(commands map[string]Command) error {
+		for _, cmd := range commands {
+			if cost := cmd.cost(); cost > limit {
+				return fmt.Errorf("command %q costs %g, more than the rate limit of %g", cmd.path(), cost, limit)
+			}
+			if err := check(cmd.Subcommands); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return check(r.commands)
+}
 
+// Buckets returns the names of the separate rate limit buckets of the
+// commands and subcommands, sorted
+func (r *CommandRegistry) Buckets() []string {
+	var buckets []string
+	var walk func(commands map[string]Command)
+	walk = func(commands map[string]Command) {
+		for _, cmd := range commands {
+			if cmd.Bucket != "" && !slices.Contains(buckets, cmd.Bucket) {
+				buckets = append(buckets, cmd.Bucket)
+			}
+			walk(cmd.Subcommands)
+		}
+	}
+	walk(r.commands)
+	sort.Strings(buckets)
+	return buckets
+}
+
+// freeText returns the index of the first argument that is left alone by
+// OutputFormat: a "--", or the first word of a variadic argument, so that
+// "help --json" still selects JSON but a ban reason is kept as it is. It
+// skips output options and flags the way resolve and parse would see them.
+func (r *CommandRegistry) freeText(args []string) int {
+	var cmd *Command
+	positional := 0
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return i
+		case arg == "-o":
+			i++
+			continue
+		case arg == "--json" || strings.HasPrefix(arg, "-o="):
+			continue
+		case strings.HasPrefix(arg, "--"):
+			if cmd != nil {
+				name, _, hasValue := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+				if flag := cmd.spec.flag(name); flag != nil && flag.valueName != "" && !hasValue {
+					i++
+				}
+			}
+			continue
+		}
+
+		if cmd == nil {
+			found, exists := r.commands[arg]
+			if !exists {
+				return len(args)
+			}
+			cmd = &found
+			continue
+		}
+		if len(cmd.Subcommands) > 0 {
+			subcmd, exists := cmd.Subcommands[arg]
+			if !exists {
+				return len(args)
+			}
+			cmd = &subcmd
+			continue
+		}
+		if fixed := cmd.spec.freeTextAt(); fixed >= 0 && positional >= fixed {
+			return i
+		}
+		positional++
+	}
+	return len(args)
+}
+
+// cost returns what running the command is charged against the rate limit
+func (cmd Command) cost() float64 {
+	if cmd.Cost > 0 {
+		return cmd.Cost
+	}
+	return ratelimit.DefaultCost
+}
+
+// usage returns the usage line of the command, generated from its spec
+func (cmd Command) usage() string {
+	if cmd.spec == nil {
+		return cmd.Usage
+	}
+	return cmd.spec.String()
+}
+
+// path returns the full name of the command, e.g. "admin ratelimit"
+func (cmd Command) path() string {
+	if cmd.spec == nil {
+		return cmd.Name
+	}
+	return strings.Join(cmd.spec.path, " ")
+}
+
+// sortedSubcommands returns the subcommands of a command ordered by name
+func sortedSubcommands(cmd Command) []Command {
 	var subcommands []Command
 	for _, subcmd := range cmd.Subcommands {
 		subcommands = append(subcommands, subcmd)
@@ -121,18 +379,95 @@ func (r *CommandRegistry) getSubcommandHelp(cmd Command) string {
 	sort.Slice(subcommands, func(i, j int) bool {
 		return subcommands[i].Name < subcommands[j].Name
 	})
+	return subcommands
+}
+
+// commandInfo describes a command in JSON help output
+type commandInfo struct {
+	Name        string        `json:"name"`
+	Usage       string        `json:"usage"`
+	Description string        `json:"description"`
+	Category    string        `json:"category,omitempty"`
+	Role        string        `json:"role,omitempty"`
+	Subcommands []commandInfo `json:"subcommands,omitempty"`
+}
+
+func (cmd Command) info() commandInfo {
+	info := commandInfo{
+		Name:        cmd.Name,
+		Usage:       cmd.usage(),
+		Description: cmd.Description,
+		Category:    cmd.Category,
+		Role:        cmd.Role,
+	}
+	for _, subcmd := range sortedSubcommands(cmd) {
+		info.Subcommands = append(info.Subcommands, subcmd.info())
+	}
+	return info
+}
+
+// Help returns the help of all commands, the text in lang
+func (r *CommandRegistry) Help(lang string) *Result {
+	var commands []commandInfo
+	for _, cmd := range r.commands {
+		commands = append(commands, cmd.info())
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Name < commands[j].Name
+	})
+
+	return &Result{
+		Text: r.GetHelpText(lang),
+		Data: map[string]any{"commands": commands},
+	}
+}
+
+// GetCommandHelp returns the usage and description of a single command,
+// given by its name and the names of its subcommands, the text in lang
+func (r *CommandRegistry) GetCommandHelp(path []string, lang string) (*Result, error) {
+	if len(path) == 0 {
+		return r.Help(lang), nil
+	}
+
+	cmd, exists := r.commands[path[0]]
+	for _, name := range path[1:] {
+		if !exists {
+			break
+		}
+		cmd, exists = cmd.Subcommands[name]
+	}
+	if !exists {
+		return nil, Errorf(CodeNotFound, "unknown command: %s", strings.Join(path, " "))
+	}
 
-	for _, subcmd := range subcommands {
-		help.WriteString(fmt.Sprintf("  %s\n    %s\n\n", subcmd.Usage, subcmd.Description))
+	var help strings.Builder
+	help.WriteString(i18n.Sprintf(lang, "Usage: %s", cmd.usage()))
+	help.WriteString(fmt.Sprintf("\n\n%s\n", i18n.T(lang, cmd.Description)))
+	if len(cmd.Subcommands) > 0 {
+		help.WriteString("\n")
+		help.WriteString(r.getSubcommandHelp(cmd, lang))
+	}
+	return &Result{Text: help.String(), Data: cmd.info()}, nil
+}
+
+// getSubcommandHelp returns help text for a command's subcommands
+func (r *CommandRegistry) getSubcommandHelp(cmd Command, lang string) string {
+	var help strings.Builder
+	help.WriteString(i18n.Sprintf(lang, "Available %s subcommands:", cmd.path()))
+	help.WriteString("\n\n")
+
+	for _, subcmd := range sortedSubcommands(cmd) {
+		help.WriteString(fmt.Sprintf("  %s\n    %s\n\n", subcmd.usage(), i18n.T(lang, subcmd.Description)))
 	}
 
 	return help.String()
 }
 
-// GetHelpText returns formatted help text for all commands
-func (r *CommandRegistry) GetHelpText() string {
+// GetHelpText returns formatted help text for all commands, in lang
+func (r *CommandRegistry) GetHelpText(lang string) string {
 	var help strings.Builder
-	help.WriteString("Available commands:\n\n")
+	help.WriteString(i18n.T(lang, "Available commands:"))
+	help.WriteString("\n\n")
 
 	categories := make(map[string][]Command)
 	for _, cmd := range r.commands {
@@ -148,22 +483,17 @@ func (r *CommandRegistry) GetHelpText() string {
 	for _, category := range categoryNames {
 		cmds := categories[category]
 		if len(cmds) > 0 {
-			help.WriteString(fmt.Sprintf("%s:\n", category))
+			help.WriteString(fmt.Sprintf("%s:\n", i18n.T(lang, category)))
 
 			sort.Slice(cmds, func(i, j int) bool {
 				return cmds[i].Name < cmds[j].Name
 			})
 
 			for _, cmd := range cmds {
-				help.WriteString(fmt.Sprintf("  %s\n", cmd.Usage))
-				help.WriteString(fmt.Sprintf("    %s\n", cmd.Description))
-
-				if len(cmd.Subcommands) > 0 {
-					for _, subcmd := range cmd.Subcommands {
-						help.WriteString(fmt.Sprintf("      %s\n", subcmd.Usage))
-						help.WriteString(fmt.Sprintf("        %s\n", subcmd.Description))
-					}
-				}
+				help.WriteString(fmt.Sprintf("  %s\n", cmd.usage()))
+				help.WriteString(fmt.Sprintf("    %s\n", i18n.T(lang, cmd.Description)))
+
+				writeSubcommandHelp(&help, cmd, "      ", lang)
 				help.WriteString("\n")
 			}
 		}
@@ -171,3 +501,13 @@ func (r *CommandRegistry) GetHelpText() string {
 
 	return help.String()
 }
+
+// writeSubcommandHelp lists the subcommands of a command and theirs,
+// indenting each level further
+func writeSubcommandHelp(help *strings.Builder, cmd Command, indent, lang string) {
+	for _, subcmd := range sortedSubcommands(cmd) {
+		help.WriteString(fmt.Sprintf("%s%s\n", indent, subcmd.usage()))
+		help.WriteString(fmt.Sprintf("%s  %s\n", indent, i18n.T(lang, subcmd.Description)))
+		writeSubcommandHelp(help, subcmd, indent+"    ", lang)
+	}
+}
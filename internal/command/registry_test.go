@@ -0,0 +1,154 @@
+package command
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// echoRegistry has commands that print their parameters as JSON, in text
+// mode too
+func echoRegistry() *CommandRegistry {
+	echo := func(ctx *CommandContext) (*Result, error) {
+		text, err := json.Marshal(ctx.Params)
+		return &Result{Text: string(text), Data: ctx.Params}, err
+	}
+	r := NewCommandRegistry()
+	r.Register(Command{Name: "get", Usage: "get <email> [--as <your-email>]", Handler: echo})
+	r.Register(Command{Name: "admin", Usage: "admin", Subcommands: map[string]Command{
+		"ban": {Name: "ban", Usage: "admin ban <target> [reason...]", Handler: echo},
+	}})
+	return r
+}
+
+func TestExecuteOutputOptions(t *testing.T) {
+	tests := []struct {
+		args []string
+		json bool
+		want Params
+	}{
+		{[]string{"get", "x@y"}, false, Params{"email": {"x@y"}}},
+		{[]string{"get", "x@y", "--json"}, true, Params{"email": {"x@y"}}},
+		{[]string{"--json", "get", "x@y"}, true, Params{"email": {"x@y"}}},
+		{[]string{"get", "-o", "json", "--as", "a@b", "x@y"}, true, Params{"email": {"x@y"}, "as": {"a@b"}}},
+		{[]string{"get", "--", "--json"}, false, Params{"email": {"--json"}}},
+
+		// Output options are text once the reason has started
+		{[]string{"admin", "ban", "t", "--json"}, true, Params{"target": {"t"}}},
+		{[]string{"admin", "ban", "t", "spam", "--json"}, false, Params{"target": {"t"}, "reason": {"spam", "--json"}}},
+		{[]string{"admin", "ban", "t", "--", "--json"}, false, Params{"target": {"t"}, "reason": {"--json"}}},
+		{[]string{"admin", "ban", "--json", "t", "spam", "-o", "json"}, true, Params{"target": {"t"}, "reason": {"spam", "-o", "json"}}},
+		{[]string{"admin", "-o=json", "ban", "t", "x", "-o=text"}, true, Params{"target": {"t"}, "reason": {"x", "-o=text"}}},
+	}
+	for _, tt := range tests {
+		output, err := echoRegistry().Execute(&CommandContext{Args: tt.args})
+		if err != nil {
+			t.Errorf("%q: %v", tt.args, err)
+			continue
+		}
+
+		var got Params
+		if tt.json {
+			var response struct {
+				OK   bool   `json:"ok"`
+				Data Params `json:"data"`
+			}
+			if err := json.Unmarshal([]byte(output), &response); err != nil || !response.OK {
+				t.Errorf("%q: not a JSON response: %q", tt.args, output)
+				continue
+			}
+			got = response.Data
+		} else if err := json.Unmarshal([]byte(output), &got); err != nil {
+			t.Errorf("%q: not text output: %q", tt.args, output)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCosts(t *testing.T) {
+	r := NewCommandRegistry()
+	r.Register(Command{Name: "whoami", Usage: "whoami"})
+	r.Register(Command{Name: "admin", Usage: "admin", Subcommands: map[string]Command{
+		"stats": {Name: "stats", Usage: "admin stats", Cost: 10},
+	}})
+	r.Register(Command{Name: "register", Usage: "register <email>", Cost: 100, Bucket: "mail"})
+
+	tests := []struct {
+		limit float64
+		err   string
+	}{
+		{1000, ""},
+		{100, ""},
+		{99, `command "register" costs 100, more than the rate limit of 99`},
+	}
+	for _, tt := range tests {
+		err := r.CheckCosts(tt.limit)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("CheckCosts(%g) = %v, want %q", tt.limit, err, tt.err)
+		}
+	}
+
+	r.Register(Command{Name: "heavy", Usage: "heavy", Subcommands: map[string]Command{
+		"run": {Name: "run", Usage: "heavy run", Cost: 500},
+	}})
+	if err := r.CheckCosts(100); err == nil || !strings.Contains(err.Error(), `"heavy run"`) {
+		t.Errorf("CheckCosts(100) with an expensive subcommand = %v", err)
+	}
+}
+
+// TestExecuteChargesBeforeIdentify checks that denied requests never reach
+// the identity function, which queries the database
+func TestExecuteChargesBeforeIdentify(t *testing.T) {
+	var identified int
+	var charged []float64
+	deny := false
+
+	r := echoRegistry()
+	r.Register(Command{Name: "register", Usage: "register <email>", Cost: 100, Bucket: "mail",
+		Handler: func(ctx *CommandContext) (*Result, error) { return Message("ok"), nil }})
+	r.SetChargeFunc(func(ctx *CommandContext, cost float64, bucket string) error {
+		charged = append(charged, cost)
+		if deny {
+			return Errorf(CodeRateLimited, "Rate-limited")
+		}
+		return nil
+	})
+	r.SetIdentityFunc(func(ctx *CommandContext) (*Caller, error) {
+		identified++
+		return &Caller{Lang: "de"}, nil
+	})
+
+	tests := []struct {
+		args       []string
+		deny       bool
+		code       string
+		cost       float64
+		identified int
+	}{
+		{[]string{"register", "x@y"}, false, "", 100, 1},
+		{[]string{"register", "x@y"}, true, CodeRateLimited, 100, 0},
+		{[]string{"register"}, false, CodeUsage, 1, 1},
+		{[]string{"nope"}, true, CodeRateLimited, 1, 0},
+	}
+	for _, tt := range tests {
+		identified, charged, deny = 0, nil, tt.deny
+		output, err := r.Execute(&CommandContext{Args: tt.args})
+		if err == nil && tt.code != "" || err != nil && ErrorCode(err) != tt.code {
+			t.Errorf("%q: err = %v, want code %q", tt.args, err, tt.code)
+		}
+		if len(charged) != 1 || charged[0] != tt.cost {
+			t.Errorf("%q: charged %v, want %g", tt.args, charged, tt.cost)
+		}
+		if identified != tt.identified {
+			t.Errorf("%q: identified %d times, want %d", tt.args, identified, tt.identified)
+		}
+		// Usage errors are still in the language of the caller
+		if tt.code == CodeUsage && !strings.Contains(output, "Aufruf") {
+			t.Errorf("%q: usage error not localized: %q", tt.args, output)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Result is the output of a command
+type Result struct {
+	Text string // Rendered in text mode, translated if it is in the catalog
+	Data any    // Rendered in JSON mode, {"message": Text} if nil
+
+	format string // Untranslated Text with its args, set by Message
+	args   []any
+}
+
+// Message returns a result that carries a human readable message, translated
+// to the language of the caller in text mode
+func Message(format string, args ...any) *Result {
+	return &Result{Text: fmt.Sprintf(format, args...), format: format, args: args}
+}
+
+// WithData sets the data rendered in JSON mode instead of the message
+func (r *Result) WithData(data any) *Result {
+	r.Data = data
+	return r
+}
+
+// Error codes reported in JSON output. They are part of the interface
+// scripts rely on, so existing codes must not change.
+const (
+	CodeUsage            = "usage"
+	CodeInvalidArgument  = "invalid_argument"
+	CodeNotFound         = "not_found"
+	CodePermissionDenied = "permission_denied"
+	CodeConflict         = "conflict"
+	CodeRateLimited      = "rate_limited"
+	CodeInternal         = "internal"
+)
+
+// Error is a command failure with an error code. Handlers return it for
+// failures caused by the caller; any other error is reported as internal.
+type Error struct {
+	Code    string
+	Message string
+	Detail  string // Shown after the message in text mode only, e.g. usage
+
+	RetryAfter time.Duration // For rate limited errors, how long to back off
+
+	err    error
+	format string // Untranslated Message with its args, set by Errorf
+	args   []any
+}
+
+// Errorf returns an error with the given code. Like fmt.Errorf, it wraps the
+// error given with %w. The message is translated to the language of the
+// caller in text mode.
+func Errorf(code, format string, args ...any) *Error {
+	err := fmt.Errorf(format, args...)
+	return &Error{Code: code, Message: err.Error(), err: errors.Unwrap(err), format: format, args: args}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// ErrorCode returns the code of the error, CodeInternal if it has none and
+// "" if err is nil
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	var cmdErr *Error
+	if errors.As(err, &cmdErr) {
+		return cmdErr.Code
+	}
+	return CodeInternal
+}
+
+// Exit statuses of failed commands, by error code
+var exitStatuses = map[string]int{
+	CodeInternal:         1,
+	CodeUsage:            2,
+	CodeNotFound:         3,
+	CodePermissionDenied: 4,
+	CodeRateLimited:      5,
+	CodeInvalidArgument:  6,
+	CodeConflict:         7,
+}
+
+// ExitStatus returns the SSH exit status for the outcome of a command
+func ExitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if status, ok := exitStatuses[ErrorCode(err)]; ok {
+		return status
+	}
+	return exitStatuses[CodeInternal]
+}
+
+// Format selects how command output is rendered
+type Format int
+
+const (
+	FormatText Format = iota
+	FormatJSON
+)
+
+// OutputFormat removes the global output options, --json and -o json|text,
+// from the arguments and returns the selected format. Options after a "--"
+// are left alone, Execute also leaves the values of variadic arguments out.
+func OutputFormat(args []string) (Format, []string, error) {
+	format := FormatText
+	rest := make([]string, 0, len(args))
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+
+		var value string
+		switch {
+		case arg == "--json":
+			value = "json"
+		case arg == "-o":
+			if i+1 >= len(args) {
+				return FormatText, nil, Errorf(CodeUsage, "flag -o requires a value: json or text")
+			}
+			i++
+			value = args[i]
+		case strings.HasPrefix(arg, "-o="):
+			value = strings.TrimPrefix(arg, "-o=")
+		default:
+			rest = append(rest, arg)
+			continue
+		}
+
+		switch value {
+		case "json":
+			format = FormatJSON
+		case "text":
+			format = FormatText
+		default:
+			return FormatText, nil, Errorf(CodeUsage, "unknown output format: %s", value)
+		}
+	}
+
+	return format, rest, nil
+}
+
+// jsonError is the error object of a failed command in JSON output
+type jsonError struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int64  `json:"retry_after,omitempty"` // Seconds
+}
+
+// jsonResponse is the object every command prints in JSON mode
+type jsonResponse struct {
+	OK    bool       `json:"ok"`
+	Data  any        `json:"data,omitempty"`
+	Error *jsonError `json:"error,omitempty"`
+}
+
+// Render formats the outcome of a command. The returned error is err as an
+// *Error, so callers can act on its code.
+func Render(format Format, result *Result, err error) (string, error) {
+	var cmdErr *Error
+	if err != nil && !errors.As(err, &cmdErr) {
+		cmdErr = &Error{Code: CodeInternal, Message: err.Error(), err: err}
+	}
+
+	if format == FormatText {
+		if cmdErr != nil {
+			if cmdErr.Detail != "" {
+				return fmt.Sprintf("Error: %s\n\n%s", cmdErr.Message, cmdErr.Detail), cmdErr
+			}
+			return fmt.Sprintf("Error: %s", cmdErr.Message), cmdErr
+		}
+		if result == nil {
+			return "", nil
+		}
+		return result.Text, nil
+	}
+
+	response := jsonResponse{OK: cmdErr == nil}
+	if cmdErr != nil {
+		response.Error = &jsonError{
+			Code:       cmdErr.Code,
+			Message:    cmdErr.Message,
+			RetryAfter: int64(math.Ceil(cmdErr.RetryAfter.Seconds())),
+		}
+	} else if result != nil {
+		response.Data = result.Data
+		if response.Data == nil {
+			response.Data = map[string]string{"message": result.Text}
+		}
+	}
+
+	var output strings.Builder
+	encoder := json.NewEncoder(&output)
+	encoder.SetEscapeHTML(false)
+	if marshalErr := encoder.Encode(response); marshalErr != nil {
+		return fmt.Sprintf(`{"ok":false,"error":{"code":%q,"message":"failed to encode output"}}`, CodeInternal),
+			&Error{Code: CodeInternal, Message: "failed to encode output", err: marshalErr}
+	}
+	if cmdErr != nil {
+		return strings.TrimSuffix(output.String(), "\n"), cmdErr
+	}
+	return strings.TrimSuffix(output.String(), "\n"), nil
+}
@@ -0,0 +1,29 @@
+package command
+
+// Admin roles. Each role may also run the commands of the roles below it.
+const (
+	RoleOwner    = "owner"    // Manages admins and the server
+	RoleOperator = "operator" // Bans users and manages rate limits
+	RoleSupport  = "support"  // Inspects users and the registry
+)
+
+var roleRanks = map[string]int{
+	RoleSupport:  1,
+	RoleOperator: 2,
+	RoleOwner:    3,
+}
+
+// ValidRole reports whether role is one of the admin roles
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// HasRole reports whether an admin with the given role, "" for callers who
+// are not admins, may run a command requiring the required role
+func HasRole(role, required string) bool {
+	if required == "" {
+		return true
+	}
+	return ValidRole(role) && roleRanks[role] >= roleRanks[required]
+}
@@ -0,0 +1,305 @@
+package command
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Usage strings describe a command's arguments:
+//
+//	<name>            required argument
+//	[name]            optional argument
+//	<name...>         one or more arguments, must come last
+//	[name...]         zero or more arguments, must come last
+//	--flag <value>    required flag with a value
+//	[--flag <value>]  optional flag with a value
+//	[--flag]          optional boolean flag
+//
+// Flags may appear anywhere among the arguments, as "--flag value" or
+// "--flag=value", up to the variadic argument: its values are taken as they
+// are, so free text may start with "--". A lone "--" ends flag parsing.
+
+// Params holds the arguments of a command, keyed by the names in its usage
+type Params map[string][]string
+
+// String returns the value of the argument or flag, or "" if it was not given
+func (p Params) String(name string) string {
+	if values := p[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Strings returns all values of a variadic argument
+func (p Params) Strings(name string) []string {
+	return p[name]
+}
+
+// Has reports whether the argument or flag was given
+func (p Params) Has(name string) bool {
+	_, ok := p[name]
+	return ok
+}
+
+// Bool reports whether a boolean flag was given
+func (p Params) Bool(name string) bool {
+	return p.Has(name)
+}
+
+// Int returns the argument parsed as an integer, or def if it was not given
+func (p Params) Int(name string, def int) (int, error) {
+	if !p.Has(name) {
+		return def, nil
+	}
+	n, err := strconv.Atoi(p.String(name))
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number", name)
+	}
+	return n, nil
+}
+
+// argSpec is a positional argument
+type argSpec struct {
+	name     string
+	optional bool
+	variadic bool
+}
+
+// flagSpec is a --flag, with or without a value
+type flagSpec struct {
+	name      string
+	valueName string // empty for boolean flags
+	optional  bool
+}
+
+// usageSpec is the parsed form of a command's usage string
+type usageSpec struct {
+	path  []string // command and subcommand names
+	args  []argSpec
+	flags []flagSpec
+}
+
+// parseUsage parses a usage string. It panics on malformed usage, which is a
+// programming error in a command definition.
+func parseUsage(usage string) *usageSpec {
+	spec := &usageSpec{}
+	tokens := tokenizeUsage(usage)
+
+	for len(tokens) > 0 && isLiteral(tokens[0]) {
+		spec.path = append(spec.path, tokens[0])
+		tokens = tokens[1:]
+	}
+
+	for _, token := range tokens {
+		optional := strings.HasPrefix(token, "[")
+		inner := token
+		if optional {
+			inner = strings.TrimSuffix(strings.TrimPrefix(token, "["), "]")
+		}
+
+		if strings.HasPrefix(inner, "--") {
+			parts := strings.Fields(inner)
+			flag := flagSpec{name: strings.TrimPrefix(parts[0], "--"), optional: optional}
+			switch len(parts) {
+			case 1:
+				if !optional {
+					panic(fmt.Sprintf("usage %q: boolean flag --%s must be optional", usage, flag.name))
+				}
+			case 2:
+				flag.valueName = strings.Trim(parts[1], "<>")
+			default:
+				panic(fmt.Sprintf("usage %q: malformed flag %q", usage, token))
+			}
+			spec.flags = append(spec.flags, flag)
+			continue
+		}
+
+		if !optional {
+			if !strings.HasPrefix(inner, "<") || !strings.HasSuffix(inner, ">") {
+				panic(fmt.Sprintf("usage %q: unexpected token %q", usage, token))
+			}
+			inner = strings.TrimSuffix(strings.TrimPrefix(inner, "<"), ">")
+		}
+		if len(spec.args) > 0 && spec.args[len(spec.args)-1].variadic {
+			panic(fmt.Sprintf("usage %q: variadic argument must come last", usage))
+		}
+		arg := argSpec{
+			name:     strings.TrimSuffix(inner, "..."),
+			optional: optional,
+			variadic: strings.HasSuffix(inner, "..."),
+		}
+		spec.args = append(spec.args, arg)
+	}
+
+	return spec
+}
+
+// tokenizeUsage splits a usage string on whitespace, keeping bracketed
+// groups such as "[--flag <value>]" and required flags with their value
+// together
+func tokenizeUsage(usage string) []string {
+	var tokens []string
+	var group []string
+	fields := strings.Fields(usage)
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		if group != nil {
+			group = append(group, field)
+			if strings.HasSuffix(field, "]") {
+				tokens = append(tokens, strings.Join(group, " "))
+				group = nil
+			}
+			continue
+		}
+		if strings.HasPrefix(field, "[") && !strings.HasSuffix(field, "]") {
+			group = []string{field}
+			continue
+		}
+		if strings.HasPrefix(field, "--") && i+1 < len(fields) && strings.HasPrefix(fields[i+1], "<") {
+			i++
+			field += " " + fields[i]
+		}
+		tokens = append(tokens, field)
+	}
+	if group != nil {
+		tokens = append(tokens, strings.Join(group, " "))
+	}
+	return tokens
+}
+
+func isLiteral(token string) bool {
+	return !strings.HasPrefix(token, "<") && !strings.HasPrefix(token, "[") && !strings.HasPrefix(token, "--")
+}
+
+// freeTextAt returns how many positional arguments come before the values
+// of the variadic argument, where flag parsing stops, or -1 if the usage has
+// no variadic argument
+func (s *usageSpec) freeTextAt() int {
+	if n := len(s.args); n > 0 && s.args[n-1].variadic {
+		return n - 1
+	}
+	return -1
+}
+
+func (s *usageSpec) flag(name string) *flagSpec {
+	for i := range s.flags {
+		if s.flags[i].name == name {
+			return &s.flags[i]
+		}
+	}
+	return nil
+}
+
+// parse matches the arguments following the command path against the spec.
+// Errors are usage errors without detail.
+func (s *usageSpec) parse(args []string) (Params, *Error) {
+	params := Params{}
+	var positional []string
+
+	fixed := s.freeTextAt()
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			positional = append(positional, args[i+1:]...)
+			break
+		}
+		if fixed >= 0 && len(positional) >= fixed {
+			positional = append(positional, args[i:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "--") {
+			positional = append(positional, arg)
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		flag := s.flag(name)
+		if flag == nil {
+			return nil, Errorf(CodeUsage, "unknown flag: --%s", name)
+		}
+		if flag.valueName == "" {
+			if hasValue {
+				return nil, Errorf(CodeUsage, "flag --%s does not take a value", name)
+			}
+			params[name] = nil
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return nil, Errorf(CodeUsage, "flag --%s requires a value", name)
+			}
+			i++
+			value = args[i]
+		}
+		params[name] = []string{value}
+	}
+
+	for _, flag := range s.flags {
+		if !flag.optional && !params.Has(flag.name) {
+			return nil, Errorf(CodeUsage, "missing flag: --%s", flag.name)
+		}
+	}
+
+	// Optional arguments are filled left to right with whatever is left
+	// after every required argument got one value
+	var required []string
+	for _, arg := range s.args {
+		if !arg.optional {
+			required = append(required, arg.name)
+		}
+	}
+	extra := len(positional) - len(required)
+	if extra < 0 {
+		return nil, Errorf(CodeUsage, "missing argument: %s", required[len(positional)])
+	}
+
+	for _, arg := range s.args {
+		switch {
+		case arg.variadic:
+			if len(positional) > 0 {
+				params[arg.name] = positional
+			}
+			positional = nil
+		case !arg.optional:
+			params[arg.name] = positional[:1]
+			positional = positional[1:]
+		case extra > 0:
+			params[arg.name] = positional[:1]
+			positional = positional[1:]
+			extra--
+		}
+	}
+	if len(positional) > 0 {
+		return nil, Errorf(CodeUsage, "too many arguments")
+	}
+
+	return params, nil
+}
+
+// String returns the canonical usage string
+func (s *usageSpec) String() string {
+	parts := append([]string{}, s.path...)
+	for _, arg := range s.args {
+		name := arg.name
+		if arg.variadic {
+			name += "..."
+		}
+		if arg.optional {
+			parts = append(parts, "["+name+"]")
+		} else {
+			parts = append(parts, "<"+name+">")
+		}
+	}
+	for _, flag := range s.flags {
+		part := "--" + flag.name
+		if flag.valueName != "" {
+			part += " <" + flag.valueName + ">"
+		}
+		if flag.optional {
+			part = "[" + part + "]"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,97 @@
+package command
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUsageString(t *testing.T) {
+	tests := []string{
+		"whoami",
+		"allow <email> [--as <your-email>]",
+		"admin ban <fingerprint-or-email> [reason...]",
+		"help [command...]",
+		"log consistency <old> <new>",
+		"x <a> [b] [--force] --to <dest>",
+	}
+	for _, usage := range tests {
+		if got := parseUsage(usage).String(); got != usage {
+			t.Errorf("parseUsage(%q).String() = %q", usage, got)
+		}
+	}
+}
+
+func TestUsageParse(t *testing.T) {
+	tests := []struct {
+		usage string
+		args  []string
+		want  Params
+		err   string
+	}{
+		{"whoami", nil, Params{}, ""},
+		{"whoami", []string{"x"}, nil, "too many arguments"},
+		{"confirm <code>", nil, nil, "missing argument: code"},
+		{"confirm <code>", []string{"ABC"}, Params{"code": {"ABC"}}, ""},
+
+		// Flags, anywhere before the variadic argument
+		{"allow <email> [--as <your-email>]", []string{"x@y", "--as", "a@b"}, Params{"email": {"x@y"}, "as": {"a@b"}}, ""},
+		{"allow <email> [--as <your-email>]", []string{"--as=a@b", "x@y"}, Params{"email": {"x@y"}, "as": {"a@b"}}, ""},
+		{"allow <email> [--as <your-email>]", []string{"x@y", "--as"}, nil, "flag --as requires a value"},
+		{"allow <email> [--as <your-email>]", []string{"--nope", "x@y"}, nil, "unknown flag: --nope"},
+		{"x <a> [--force]", []string{"--force", "1"}, Params{"a": {"1"}, "force": nil}, ""},
+		{"x <a> [--force]", []string{"1", "--force=yes"}, nil, "flag --force does not take a value"},
+		{"x <a> --to <dest>", []string{"1"}, nil, "missing flag: --to"},
+
+		// A lone "--" ends flag parsing
+		{"confirm <code>", []string{"--", "--x"}, Params{"code": {"--x"}}, ""},
+		{"x <a> [--force]", []string{"--", "--force"}, Params{"a": {"--force"}}, ""},
+
+		// Optional arguments are filled left to right
+		{"x <a> [b] <c>", []string{"1", "2"}, Params{"a": {"1"}, "c": {"2"}}, ""},
+		{"x <a> [b] <c>", []string{"1", "2", "3"}, Params{"a": {"1"}, "b": {"2"}, "c": {"3"}}, ""},
+
+		// Variadic values are taken as they are, flags included
+		{"admin ban <target> [reason...]", []string{"t"}, Params{"target": {"t"}}, ""},
+		{"admin ban <target> [reason...]", []string{"t", "spam", "bot"}, Params{"target": {"t"}, "reason": {"spam", "bot"}}, ""},
+		{"admin ban <target> [reason...]", []string{"t", "--spam", "--", "bot"}, Params{"target": {"t"}, "reason": {"--spam", "--", "bot"}}, ""},
+		{"admin ban <target> [reason...]", []string{"--", "--t", "x"}, Params{"target": {"--t"}, "reason": {"x"}}, ""},
+		{"admin ban <target> [reason...]", []string{"--t"}, nil, "unknown flag: --t"},
+		{"help [command...]", []string{"--version"}, Params{"command": {"--version"}}, ""},
+		{"x <a> <b...>", []string{"1"}, nil, "missing argument: b"},
+		{"x <a> <b...> [--force]", []string{"--force", "1", "2", "--force"}, Params{"a": {"1"}, "b": {"2", "--force"}, "force": nil}, ""},
+	}
+	for _, tt := range tests {
+		got, err := parseUsage(tt.usage).parse(tt.args)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q %q: err = %v, want %q", tt.usage, tt.args, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q %q: %v", tt.usage, tt.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q %q = %v, want %v", tt.usage, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestParseUsagePanics(t *testing.T) {
+	tests := []string{
+		"x --force",
+		"x <a...> <b>",
+		"x a <b> c",
+	}
+	for _, usage := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("parseUsage(%q) did not panic", usage)
+				}
+			}()
+			parseUsage(usage)
+		}()
+	}
+}
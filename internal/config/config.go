@@ -12,6 +12,12 @@ type Config struct {
 		Port              int    `json:"port"`
 		HostKey           string `json:"host_key_path"`
 		HostKeyPassphrase string `json:"host_key_passphrase"`
+
+		// Name users connect to, as in "ssh keypub.sh confirm <code>"
+		Hostname string `json:"hostname"`
+
+		// Fingerprints made owners on startup if they are not admins yet
+		BootstrapAdmins []string `json:"bootstrap_admins"`
 	} `json:"server"`
 
 	Database struct {
@@ -22,6 +28,13 @@ type Config struct {
 		Limit    float64       `json:"limit"`
 		Duration time.Duration `json:"duration"`
 		Strict   bool          `json:"strict"`
+
+		// Per remote IP, IPv6 addresses are grouped by /64
+		IP struct {
+			Limit    float64       `json:"limit"`
+			Duration time.Duration `json:"duration"`
+			Strict   bool          `json:"strict"`
+		} `json:"ip"`
 	} `json:"rate_limit"`
 
 	Verification struct {
@@ -32,7 +45,12 @@ type Config struct {
 		EmailService string `json:"email_service"`
 		FromEmail    string `json:"from_email"`
 		FromName     string `json:"from_name"`
-		Resend       struct {
+
+		// Directory with confirmation.txt and confirmation.html overriding
+		// the built-in templates, both optional
+		TemplateDir string `json:"template_dir"`
+
+		Resend struct {
 			ResendKeyPath string `json:"resend_key_path"`
 		} `json:"resend"`
 		SMTP struct {
@@ -40,7 +58,29 @@ type Config struct {
 			Port     int    `json:"port"`
 			Username string `json:"username"`
 			Password string `json:"password"`
-			Secure   bool   `json:"secure"`
+
+			// Deprecated: implicit TLS if tls is not set, use tls instead
+			Secure bool `json:"secure"`
+
+			// implicit, starttls, opportunistic or none. If not set,
+			// implicit with secure and opportunistic without, as before
+			// tls existed.
+			TLS string `json:"tls"`
+			// plain, login, cram-md5 or none, picked from the mechanisms
+			// offered by the server if not set
+			Auth string `json:"auth"`
+
+			// For connecting and for sending one mail, defaults if zero
+			ConnectTimeout time.Duration `json:"connect_timeout"`
+			Timeout        time.Duration `json:"timeout"`
+
+			// Mails are DKIM signed if key_path is set, with the domain
+			// of from_email if domain is not set
+			DKIM struct {
+				KeyPath  string `json:"key_path"` // PEM encoded RSA or Ed25519 key
+				Selector string `json:"selector"`
+				Domain   string `json:"domain"`
+			} `json:"dkim"`
 		} `json:"smtp"`
 	} `json:"email"`
 
@@ -66,6 +106,7 @@ func NewConfig() *Config {
 	config.Server.Port = 22
 	config.Server.HostKey = "/home/ubuntu/.keys/.host"
 	config.Server.HostKeyPassphrase = ""
+	config.Server.Hostname = "keypub.sh"
 
 	// Database defaults
 	config.Database.Path = "/home/ubuntu/data/keysdb.sqlite3"
@@ -74,6 +115,9 @@ func NewConfig() *Config {
 	config.RateLimit.Limit = 600
 	config.RateLimit.Duration = 10 * time.Hour
 	config.RateLimit.Strict = false
+	config.RateLimit.IP.Limit = 1200
+	config.RateLimit.IP.Duration = 10 * time.Hour
+	config.RateLimit.IP.Strict = false
 
 	// Verification defaults
 	config.Verification.Duration = 1 * time.Hour
@@ -107,6 +151,7 @@ func NewTestConfig() *Config {
 	config.Server.Port = 2288
 	config.Server.HostKey = "/home/ubuntu/.keys/.host"
 	config.Server.HostKeyPassphrase = ""
+	config.Server.Hostname = "keypub.sh"
 
 	// Database test settings
 	config.Database.Path = "/home/ubuntu/data_test/keysdb.sqlite3"
@@ -115,6 +160,9 @@ func NewTestConfig() *Config {
 	config.RateLimit.Limit = 1000
 	config.RateLimit.Duration = 1 * time.Hour
 	config.RateLimit.Strict = false
+	config.RateLimit.IP.Limit = 2000
+	config.RateLimit.IP.Duration = 1 * time.Hour
+	config.RateLimit.IP.Strict = false
 
 	// Verification test settings
 	config.Verification.Duration = 5 * time.Minute
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"log"
+)
+
+//go:embed schema.sql
+var schema string
+
+// migrations brings databases created from an older schema.sql up to date.
+// Entry i upgrades a database from user_version i to i+1. A fresh database
+// is created directly from schema.sql, which sets user_version to the latest
+// version, so every schema change must be made in both places.
+var migrations = []string{
+	// 0 -> 1: store the full public key alongside the fingerprint
+	`ALTER TABLE ssh_keys ADD COLUMN public_key TEXT;
+	ALTER TABLE ssh_keys ADD COLUMN key_type TEXT;
+	ALTER TABLE ssh_keys ADD COLUMN key_bits INTEGER;`,
+	// 1 -> 2: transparency log
+	`CREATE TABLE transparency_log (
+		leaf_index INTEGER NOT NULL PRIMARY KEY,
+		leaf_data TEXT NOT NULL,
+		leaf_hash TEXT NOT NULL,
+		created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+	);`,
+	// 2 -> 3: multiple emails per fingerprint, the oldest one becomes primary
+	`ALTER TABLE ssh_keys ADD COLUMN is_primary INTEGER NOT NULL DEFAULT 0;
+	UPDATE ssh_keys SET is_primary = 1
+		WHERE rowid IN (SELECT MIN(rowid) FROM ssh_keys GROUP BY fingerprint);`,
+	// 3 -> 4: rate limiter state survives restarts
+	`CREATE TABLE rate_limit_state (
+		limiter TEXT NOT NULL,
+		client_id TEXT NOT NULL,
+		rate REAL NOT NULL,
+		updated_at REAL NOT NULL,
+		PRIMARY KEY (limiter, client_id)
+	);`,
+	// 4 -> 5: rate limit exceptions managed by admins
+	`CREATE TABLE rate_limit_rules (
+		target TEXT NOT NULL PRIMARY KEY,
+		action TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+	);`,
+	// 5 -> 6: banned keys and emails
+	`CREATE TABLE bans (
+		target TEXT NOT NULL PRIMARY KEY,
+		reason TEXT NOT NULL DEFAULT '',
+		created_by TEXT NOT NULL,
+		created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+	);`,
+	// 6 -> 7: failed mails, for admin stats
+	`CREATE TABLE mail_failures (
+		id INTEGER NOT NULL PRIMARY KEY,
+		recipient TEXT NOT NULL,
+		error TEXT NOT NULL,
+		created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+	);
+	CREATE INDEX idx_mail_failures_created_at ON mail_failures(created_at);`,
+	// 7 -> 8: admin roles, existing admins keep full access as owners
+	`ALTER TABLE admin_fingerprints ADD COLUMN role TEXT NOT NULL DEFAULT 'owner';`,
+	// 8 -> 9: mails are queued and sent in the background
+	`CREATE TABLE mail_outbox (
+		id INTEGER NOT NULL PRIMARY KEY,
+		recipients TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		html TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+	);
+	CREATE INDEX idx_mail_outbox_next_attempt_at ON mail_outbox(next_attempt_at);`,
+	// 9 -> 10: mails have a plain text part
+	`ALTER TABLE mail_outbox ADD COLUMN text TEXT NOT NULL DEFAULT '';`,
+	// 10 -> 11: keys have a preferred language
+	`CREATE TABLE key_preferences (
+		fingerprint TEXT NOT NULL PRIMARY KEY,
+		lang TEXT NOT NULL,
+		updated_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+	);`,
+	// 11 -> 12: the tree head is extended with every leaf instead of being
+	// recomputed, older leaves get their frontier from BackfillFrontiers in
+	// translog at startup
+	`ALTER TABLE transparency_log ADD COLUMN frontier TEXT;`,
+	// 12 -> 13: mails know the verification code they carry, so giving up on
+	// one drops that code only
+	`ALTER TABLE mail_outbox ADD COLUMN fingerprint TEXT NOT NULL DEFAULT '';
+	ALTER TABLE mail_outbox ADD COLUMN code TEXT NOT NULL DEFAULT '';`,
+}
+
+// Migrate creates the schema in an empty database, or applies any pending
+// migrations to an existing one.
+func Migrate(db *sql.DB) error {
+	var tables int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'ssh_keys'").Scan(&tables)
+	if err != nil {
+		return fmt.Errorf("inspecting schema: %w", err)
+	}
+	if tables == 0 {
+		log.Printf("Empty database, creating schema version %d", len(migrations))
+		if _, err := db.Exec(schema); err != nil {
+			return fmt.Errorf("creating schema: %w", err)
+		}
+		return nil
+	}
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+
+	for ; version < len(migrations); version++ {
+		log.Printf("Migrating database schema from version %d to %d", version, version+1)
+		if err := applyMigration(db, version); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func applyMigration(db *sql.DB, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	if _, err := tx.Exec(migrations[version]); err != nil {
+		return fmt.Errorf("migration %d failed: %w", version+1, err)
+	}
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+		return fmt.Errorf("failed to set schema version: %w", err)
+	}
+
+	return tx.Commit()
+}
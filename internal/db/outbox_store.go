@@ -0,0 +1,192 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"keypub/internal/db/.gen/table"
+	"keypub/internal/mail"
+
+	. "github.com/go-jet/jet/v2/sqlite"
+)
+
+// OutboxStore keeps the mail outbox in the database
+type OutboxStore struct {
+	db *sql.DB
+}
+
+func NewOutboxStore(db *sql.DB) *OutboxStore {
+	return &OutboxStore{db: db}
+}
+
+func (s *OutboxStore) Enqueue(msg mail.Message) error {
+	recipients, err := json.Marshal(msg.To)
+	if err != nil {
+		return fmt.Errorf("failed to encode recipients: %w", err)
+	}
+
+	_, err = table.MailOutbox.INSERT(
+		table.MailOutbox.Recipients,
+		table.MailOutbox.Subject,
+		table.MailOutbox.Text,
+		table.MailOutbox.HTML,
+		table.MailOutbox.Fingerprint,
+		table.MailOutbox.Code,
+	).VALUES(
+		string(recipients),
+		msg.Content.Subject,
+		msg.Content.Text,
+		msg.Content.HTML,
+		msg.Fingerprint,
+		msg.Code,
+	).Exec(s.db)
+
+	if err != nil {
+		return fmt.Errorf("failed to insert mail: %w", err)
+	}
+	return nil
+}
+
+func (s *OutboxStore) Due(now time.Time, limit int) ([]mail.Message, error) {
+	var rows []struct {
+		ID          int64
+		Recipients  string
+		Subject     string
+		Text        string
+		HTML        string
+		Attempts    int64
+		Fingerprint string
+		Code        string
+		CreatedAt   int64
+	}
+	err := SELECT(
+		table.MailOutbox.ID.AS("id"),
+		table.MailOutbox.Recipients.AS("recipients"),
+		table.MailOutbox.Subject.AS("subject"),
+		table.MailOutbox.Text.AS("text"),
+		table.MailOutbox.HTML.AS("html"),
+		table.MailOutbox.Attempts.AS("attempts"),
+		table.MailOutbox.Fingerprint.AS("fingerprint"),
+		table.MailOutbox.Code.AS("code"),
+		table.MailOutbox.CreatedAt.AS("created_at"),
+	).FROM(
+		table.MailOutbox,
+	).WHERE(
+		table.MailOutbox.NextAttemptAt.LT_EQ(Int64(now.Unix())),
+	).ORDER_BY(
+		table.MailOutbox.NextAttemptAt.ASC(),
+		table.MailOutbox.ID.ASC(),
+	).LIMIT(
+		int64(limit),
+	).Query(s.db, &rows)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query mail outbox: %w", err)
+	}
+
+	messages := make([]mail.Message, len(rows))
+	for i, row := range rows {
+		var to []string
+		if err := json.Unmarshal([]byte(row.Recipients), &to); err != nil {
+			return nil, fmt.Errorf("failed to decode recipients of mail %d: %w", row.ID, err)
+		}
+		messages[i] = mail.Message{
+			ID: row.ID,
+			To: to,
+			Content: mail.Content{
+				Subject: row.Subject,
+				Text:    row.Text,
+				HTML:    row.HTML,
+			},
+			Attempts:    int(row.Attempts),
+			Queued:      time.Unix(row.CreatedAt, 0),
+			Fingerprint: row.Fingerprint,
+			Code:        row.Code,
+		}
+	}
+	return messages, nil
+}
+
+func (s *OutboxStore) Retry(msg mail.Message, next time.Time, sendErr error) error {
+	_, err := table.MailOutbox.UPDATE().
+		SET(
+			table.MailOutbox.Attempts.SET(Int64(int64(msg.Attempts+1))),
+			table.MailOutbox.NextAttemptAt.SET(Int64(next.Unix())),
+			table.MailOutbox.LastError.SET(String(sendErr.Error())),
+		).
+		WHERE(table.MailOutbox.ID.EQ(Int64(msg.ID))).
+		Exec(s.db)
+
+	if err != nil {
+		return fmt.Errorf("failed to reschedule mail: %w", err)
+	}
+	return nil
+}
+
+func (s *OutboxStore) Delete(id int64) error {
+	_, err := table.MailOutbox.DELETE().
+		WHERE(table.MailOutbox.ID.EQ(Int64(id))).
+		Exec(s.db)
+
+	if err != nil {
+		return fmt.Errorf("failed to delete mail: %w", err)
+	}
+	return nil
+}
+
+// Fail moves the message to the mail failures shown in admin stats. The
+// verification code the message carries is deleted, as it never arrived and
+// the key could not register the address again until it expired. Other
+// codes for the same address, sent to other keys or later, are kept.
+func (s *OutboxStore) Fail(msg mail.Message, sendErr error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	_, err = table.MailFailures.
+		INSERT(table.MailFailures.Recipient, table.MailFailures.Error).
+		VALUES(String(strings.Join(msg.To, ", ")), String(sendErr.Error())).
+		Exec(tx)
+	if err != nil {
+		return fmt.Errorf("failed to record mail failure: %w", err)
+	}
+
+	_, err = table.MailOutbox.DELETE().
+		WHERE(table.MailOutbox.ID.EQ(Int64(msg.ID))).
+		Exec(tx)
+	if err != nil {
+		return fmt.Errorf("failed to delete mail: %w", err)
+	}
+
+	if msg.Code != "" {
+		recipients := make([]Expression, len(msg.To))
+		for i, to := range msg.To {
+			recipients[i] = String(to)
+		}
+		_, err = table.VerificationCodes.DELETE().
+			WHERE(
+				table.VerificationCodes.Email.IN(recipients...).
+					AND(table.VerificationCodes.Fingerprint.EQ(String(msg.Fingerprint))).
+					AND(table.VerificationCodes.Code.EQ(String(msg.Code))),
+			).
+			Exec(tx)
+		if err != nil {
+			return fmt.Errorf("failed to delete pending verification: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"keypub/internal/mail"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1) // Every connection would get its own database
+	t.Cleanup(func() { db.Close() })
+
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// TestOutboxFailKeepsOtherCodes gives up on one confirmation mail while
+// other keys, and the same key later, have codes pending for the address
+func TestOutboxFailKeepsOtherCodes(t *testing.T) {
+	db := openTestDB(t)
+	store := NewOutboxStore(db)
+
+	codes := []struct{ fingerprint, code string }{
+		{"SHA256:a", "AAAA-1111"}, // The code of the failed mail
+		{"SHA256:b", "BBBB-2222"}, // Another key registering the address
+	}
+	for _, c := range codes {
+		_, err := db.Exec("INSERT INTO verification_codes (email, fingerprint, code) VALUES (?, ?, ?)",
+			"a@example.org", c.fingerprint, c.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs := []mail.Message{
+		{To: []string{"a@example.org"}, Fingerprint: "SHA256:a", Code: "AAAA-1111"},
+		{To: []string{"a@example.org"}, Fingerprint: "SHA256:b", Code: "BBBB-2222"},
+		{To: []string{"a@example.org"}}, // Not a confirmation
+	}
+	for _, msg := range msgs {
+		if err := store.Enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	due, err := store.Due(time.Now(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != len(msgs) {
+		t.Fatalf("Due returned %d mails, want %d", len(due), len(msgs))
+	}
+	if due[0].Fingerprint != "SHA256:a" || due[0].Code != "AAAA-1111" {
+		t.Fatalf("Due lost the verification of the mail: %+v", due[0])
+	}
+
+	// A mail without code drops none
+	if err := store.Fail(due[2], errors.New("down")); err != nil {
+		t.Fatal(err)
+	}
+	checkCodes(t, db, "SHA256:a", "SHA256:b")
+
+	if err := store.Fail(due[0], errors.New("down")); err != nil {
+		t.Fatal(err)
+	}
+	checkCodes(t, db, "SHA256:b")
+
+	// A later register of the same key replaced the code of the failed mail
+	if _, err := db.Exec("INSERT INTO verification_codes (email, fingerprint, code) VALUES (?, ?, ?)",
+		"a@example.org", "SHA256:a", "CCCC-3333"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Fail(due[0], errors.New("down")); err != nil {
+		t.Fatal(err)
+	}
+	checkCodes(t, db, "SHA256:a", "SHA256:b")
+
+	var failures int
+	if err := db.QueryRow("SELECT COUNT(*) FROM mail_failures").Scan(&failures); err != nil {
+		t.Fatal(err)
+	}
+	if failures != 3 {
+		t.Errorf("%d mail failures recorded, want 3", failures)
+	}
+}
+
+// checkCodes compares the keys with a pending code for a@example.org
+func checkCodes(t *testing.T, db *sql.DB, want ...string) {
+	t.Helper()
+	rows, err := db.Query("SELECT fingerprint FROM verification_codes WHERE email = ? ORDER BY fingerprint", "a@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var got []string
+	for rows.Next() {
+		var fingerprint string
+		if err := rows.Scan(&fingerprint); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fingerprint)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("pending codes for %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("pending codes for %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"keypub/internal/db/.gen/table"
+	"keypub/internal/ratelimit"
+
+	. "github.com/go-jet/jet/v2/sqlite"
+)
+
+// saveBatchSize bounds the rows per INSERT, to stay below SQLite's limit on
+// bound variables
+const saveBatchSize = 500
+
+// RateLimitStore keeps the state of one rate limiter in the database
+type RateLimitStore struct {
+	db      *sql.DB
+	limiter string
+}
+
+func NewRateLimitStore(db *sql.DB, limiter string) *RateLimitStore {
+	return &RateLimitStore{
+		db:      db,
+		limiter: limiter,
+	}
+}
+
+func (s *RateLimitStore) Load() ([]ratelimit.ClientState, error) {
+	// Scanned into float64, the generated model has float32 for REAL
+	var rows []struct {
+		ClientID  string
+		Rate      float64
+		UpdatedAt float64
+	}
+	err := SELECT(
+		table.RateLimitState.ClientID.AS("client_id"),
+		table.RateLimitState.Rate.AS("rate"),
+		table.RateLimitState.UpdatedAt.AS("updated_at"),
+	).FROM(
+		table.RateLimitState,
+	).WHERE(
+		table.RateLimitState.Limiter.EQ(String(s.limiter)),
+	).Query(s.db, &rows)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rate limit state: %w", err)
+	}
+
+	clients := make([]ratelimit.ClientState, len(rows))
+	for i, row := range rows {
+		seconds, fraction := math.Modf(row.UpdatedAt)
+		clients[i] = ratelimit.ClientState{
+			ID:   row.ClientID,
+			Time: time.Unix(int64(seconds), int64(fraction*1e9)),
+			Rate: row.Rate,
+		}
+	}
+	return clients, nil
+}
+
+func (s *RateLimitStore) Save(clients []ratelimit.ClientState) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	_, err = table.RateLimitState.DELETE().
+		WHERE(table.RateLimitState.Limiter.EQ(String(s.limiter))).
+		Exec(tx)
+	if err != nil {
+		return fmt.Errorf("failed to delete rate limit state: %w", err)
+	}
+
+	for start := 0; start < len(clients); start += saveBatchSize {
+		end := min(start+saveBatchSize, len(clients))
+
+		stmt := table.RateLimitState.INSERT(
+			table.RateLimitState.Limiter,
+			table.RateLimitState.ClientID,
+			table.RateLimitState.Rate,
+			table.RateLimitState.UpdatedAt,
+		)
+		for _, client := range clients[start:end] {
+			stmt = stmt.VALUES(
+				s.limiter,
+				client.ID,
+				Float(client.Rate),
+				Float(float64(client.Time.UnixNano())/1e9),
+			)
+		}
+		if _, err = stmt.Exec(tx); err != nil {
+			return fmt.Errorf("failed to insert rate limit state: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
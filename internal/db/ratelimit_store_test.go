@@ -0,0 +1,93 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"keypub/internal/ratelimit"
+)
+
+func TestRateLimitStoreRoundTrip(t *testing.T) {
+	db := openTestDB(t)
+	store := NewRateLimitStore(db, "fingerprint")
+	other := NewRateLimitStore(db, "ip")
+
+	now := time.Unix(1700000000, 123456789)
+	tests := []int{0, 3, saveBatchSize*2 + 1} // Number of clients saved
+	for _, n := range tests {
+		saved := make([]ratelimit.ClientState, n)
+		for i := range saved {
+			saved[i] = ratelimit.ClientState{
+				ID:   fmt.Sprintf("SHA256:%d", i),
+				Time: now.Add(time.Duration(i) * time.Second),
+				Rate: float64(i) + 0.25,
+			}
+		}
+		if err := other.Save([]ratelimit.ClientState{{ID: "192.0.2.1", Time: now, Rate: 1}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Save(saved); err != nil {
+			t.Fatal(err)
+		}
+
+		loaded, err := store.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(loaded) != n {
+			t.Fatalf("%d clients saved, %d loaded", n, len(loaded))
+		}
+		byID := make(map[string]ratelimit.ClientState, n)
+		for _, client := range loaded {
+			byID[client.ID] = client
+		}
+		for _, want := range saved {
+			got, ok := byID[want.ID]
+			if !ok {
+				t.Fatalf("client %s not loaded", want.ID)
+			}
+			if got.Rate != want.Rate {
+				t.Errorf("client %s rate = %g, want %g", want.ID, got.Rate, want.Rate)
+			}
+			// Times are stored as float seconds, precise to the microsecond
+			if d := got.Time.Sub(want.Time); math.Abs(float64(d)) > float64(time.Microsecond) {
+				t.Errorf("client %s time = %s, want %s", want.ID, got.Time, want.Time)
+			}
+		}
+
+		// Saving one limiter leaves the others alone
+		if loaded, err := other.Load(); err != nil || len(loaded) != 1 {
+			t.Fatalf("other limiter loaded %d clients, err = %v", len(loaded), err)
+		}
+	}
+}
+
+// TestRateLimiterRestore snapshots a limiter on Stop and restores it in a new one
+func TestRateLimiterRestore(t *testing.T) {
+	db := openTestDB(t)
+	store := NewRateLimitStore(db, "fingerprint")
+
+	rl := ratelimit.NewRateLimiter(10, time.Hour, false, store)
+	rl.Check("a", 4)
+	rl.Check("b", 1)
+	rl.Check("b", 1)
+	rateA, _ := rl.GetRate("a")
+	rateB, _ := rl.GetRate("b")
+	rl.Stop()
+
+	restored := ratelimit.NewRateLimiter(10, time.Hour, false, store)
+	defer restored.Stop()
+	for id, want := range map[string]float64{"a": rateA, "b": rateB} {
+		got, ok := restored.GetRate(id)
+		if !ok || got != want {
+			t.Errorf("restored rate of %s = %g, %v, want %g", id, got, ok, want)
+		}
+	}
+
+	// The restored rate still counts against the limit
+	if restored.Check("a", 7).Allowed {
+		t.Error("request above the restored rate allowed")
+	}
+}
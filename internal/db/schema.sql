@@ -1,7 +1,14 @@
+-- Schema version, must match the number of migrations in migrate.go
+PRAGMA user_version = 13;
+
 -- SSH Keys table (main data store)
 CREATE TABLE ssh_keys (
     email TEXT NOT NULL,                   -- Owner's email
     fingerprint TEXT NOT NULL,             -- SSH key fingerprint
+    public_key TEXT,                       -- Key in authorized_keys format (NULL until backfilled for old rows)
+    key_type TEXT,                         -- Key algorithm, e.g. ssh-ed25519
+    key_bits INTEGER,                      -- Key size in bits
+    is_primary INTEGER NOT NULL DEFAULT 0, -- 1 for the fingerprint's primary email
     created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
     UNIQUE(email, fingerprint)
 );
@@ -36,7 +43,77 @@ CREATE INDEX idx_email_permissions_grantee ON email_permissions(grantee_email);
 -- Admin fingerprints table
 CREATE TABLE admin_fingerprints (
     fingerprint TEXT NOT NULL PRIMARY KEY,  -- SSH key fingerprint of admin
+    role TEXT NOT NULL DEFAULT 'owner',     -- owner, operator or support
     created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
 );
 
 CREATE INDEX idx_admin_fingerprints_fp ON admin_fingerprints(fingerprint);
+
+-- Transparency log (append-only Merkle tree leaves of registry mutations)
+CREATE TABLE transparency_log (
+    leaf_index INTEGER NOT NULL PRIMARY KEY, -- 0-based position in the tree
+    leaf_data TEXT NOT NULL,                 -- JSON encoded entry
+    leaf_hash TEXT NOT NULL,                 -- Hex encoded RFC 9162 leaf hash of leaf_data
+    frontier TEXT,                           -- Roots of the perfect subtrees of the tree up to this leaf, largest first, hex and comma separated
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+);
+
+-- Rate limiter state, saved periodically and restored on startup
+CREATE TABLE rate_limit_state (
+    limiter TEXT NOT NULL,         -- Name of the rate limiter, e.g. ip
+    client_id TEXT NOT NULL,       -- Fingerprint or address, prefixed by bucket if any
+    rate REAL NOT NULL,            -- EWMA rate at updated_at
+    updated_at REAL NOT NULL,      -- Unix time of the client's last request
+    PRIMARY KEY (limiter, client_id)
+);
+
+-- Rate limit exceptions managed by admins
+CREATE TABLE rate_limit_rules (
+    target TEXT NOT NULL PRIMARY KEY,  -- Key fingerprint or address range in CIDR notation
+    action TEXT NOT NULL,              -- allow: not rate limited, block: always refused
+    created_by TEXT NOT NULL,          -- Fingerprint of the admin who added the rule
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+);
+
+-- Banned keys, rejected at authentication, and banned emails, which cannot
+-- be registered or looked up
+CREATE TABLE bans (
+    target TEXT NOT NULL PRIMARY KEY,  -- SSH key fingerprint or email
+    reason TEXT NOT NULL DEFAULT '',
+    created_by TEXT NOT NULL,          -- Fingerprint of the admin who added the ban
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+);
+
+-- Mails that could not be sent, for admin stats
+CREATE TABLE mail_failures (
+    id INTEGER NOT NULL PRIMARY KEY,
+    recipient TEXT NOT NULL,
+    error TEXT NOT NULL,
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+);
+
+CREATE INDEX idx_mail_failures_created_at ON mail_failures(created_at);
+
+-- Mails waiting to be sent, retried with backoff until sent or given up on
+CREATE TABLE mail_outbox (
+    id INTEGER NOT NULL PRIMARY KEY,
+    recipients TEXT NOT NULL,              -- JSON array of addresses
+    subject TEXT NOT NULL,
+    text TEXT NOT NULL DEFAULT '',        -- Plain text part, empty for mails queued before it existed
+    html TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,   -- Failed attempts so far
+    next_attempt_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    last_error TEXT NOT NULL DEFAULT '',
+    fingerprint TEXT NOT NULL DEFAULT '',  -- Key of the verification code the mail carries, if any
+    code TEXT NOT NULL DEFAULT '',         -- Verification code the mail carries, if any
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+);
+
+CREATE INDEX idx_mail_outbox_next_attempt_at ON mail_outbox(next_attempt_at);
+
+-- Settings of a key, which may be set before the key is registered
+CREATE TABLE key_preferences (
+    fingerprint TEXT NOT NULL PRIMARY KEY,
+    lang TEXT NOT NULL,                    -- Language of command output and mails
+    updated_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+);
@@ -0,0 +1,83 @@
+// Package i18n translates user facing messages. Messages are looked up by
+// their English text, which is also what is shown when a language has no
+// translation for them.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DefaultLang is the language messages are written in
+const DefaultLang = "en"
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// catalog maps languages to the translations of English messages
+var catalog = loadCatalog()
+
+// loadCatalog reads the embedded locales. It panics on malformed files,
+// which are a programming error.
+func loadCatalog() map[string]map[string]string {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(fmt.Sprintf("failed to read locales: %v", err))
+	}
+
+	catalog := map[string]map[string]string{DefaultLang: {}}
+	for _, file := range files {
+		content, err := localeFiles.ReadFile(path.Join("locales", file.Name()))
+		if err != nil {
+			panic(fmt.Sprintf("failed to read locale %s: %v", file.Name(), err))
+		}
+		messages := map[string]string{}
+		if err := json.Unmarshal(content, &messages); err != nil {
+			panic(fmt.Sprintf("failed to parse locale %s: %v", file.Name(), err))
+		}
+		catalog[strings.TrimSuffix(file.Name(), ".json")] = messages
+	}
+	return catalog
+}
+
+// Languages returns the supported language codes, sorted
+func Languages() []string {
+	languages := make([]string, 0, len(catalog))
+	for lang := range catalog {
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// Match returns the supported language for a code such as "de", "de-AT" or
+// "de_DE.UTF-8", and whether there is one
+func Match(code string) (string, bool) {
+	lang := strings.ToLower(code)
+	if i := strings.IndexAny(lang, "-_."); i >= 0 {
+		lang = lang[:i]
+	}
+	_, ok := catalog[lang]
+	return lang, ok
+}
+
+// T returns the translation of msg, or msg itself if there is none
+func T(lang, msg string) string {
+	if translated, ok := catalog[lang][msg]; ok {
+		return translated
+	}
+	return msg
+}
+
+// Sprintf formats the translation of format. Without args, the translation
+// is returned as is.
+func Sprintf(lang, format string, args ...any) string {
+	if len(args) == 0 {
+		return T(lang, format)
+	}
+	return fmt.Sprintf(T(lang, format), args...)
+}
@@ -0,0 +1,216 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// dkimSignedHeaders are signed if the message has them, in this order
+var dkimSignedHeaders = []string{"from", "to", "subject", "date", "message-id", "mime-version", "content-type"}
+
+// DKIMSigner adds a DKIM-Signature header to messages (RFC 6376), with
+// relaxed canonicalization of headers and body. RSA keys sign with
+// rsa-sha256, Ed25519 keys with ed25519-sha256 (RFC 8463).
+type DKIMSigner struct {
+	domain    string
+	selector  string
+	key       crypto.Signer
+	algorithm string
+}
+
+// NewDKIMSigner loads the PEM encoded private key at keyPath, in PKCS #8
+// or, for RSA, PKCS #1 form
+func NewDKIMSigner(domain, selector, keyPath string) (*DKIMSigner, error) {
+	if domain == "" || selector == "" {
+		return nil, errors.New("dkim needs a domain and a selector")
+	}
+
+	content, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dkim key: %w", err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in dkim key %s", keyPath)
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported dkim key type: %s", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse dkim key: %w", err)
+	}
+
+	signer := &DKIMSigner{domain: domain, selector: selector}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signer.key, signer.algorithm = key, "rsa-sha256"
+	case ed25519.PrivateKey:
+		signer.key, signer.algorithm = key, "ed25519-sha256"
+	default:
+		return nil, fmt.Errorf("dkim key must be RSA or Ed25519, not %T", key)
+	}
+	return signer, nil
+}
+
+// DNSRecord returns the name and the content of the TXT record publishing
+// the public key
+func (s *DKIMSigner) DNSRecord() (string, string, error) {
+	name := fmt.Sprintf("%s._domainkey.%s", s.selector, s.domain)
+	switch key := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to encode dkim public key: %w", err)
+		}
+		return name, "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return name, "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key), nil
+	}
+	return "", "", fmt.Errorf("unsupported dkim public key %T", s.key.Public())
+}
+
+// Sign returns the message, with CRLF line endings, preceded by its
+// DKIM-Signature header
+func (s *DKIMSigner) Sign(message []byte) ([]byte, error) {
+	header, body, found := bytes.Cut(message, []byte("\r\n\r\n"))
+	if !found {
+		return nil, errors.New("message has no body")
+	}
+	fields := parseHeader(string(header) + "\r\n")
+
+	var signed []string
+	var canonicalHeaders strings.Builder
+	for _, name := range dkimSignedHeaders {
+		if field, ok := fields[name]; ok {
+			signed = append(signed, name)
+			canonicalHeaders.WriteString(relaxedHeader(field))
+		}
+	}
+	if len(signed) == 0 || signed[0] != "from" {
+		return nil, errors.New("message has no From header")
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	signature := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n"+
+		"\tt=%d; h=%s;\r\n"+
+		"\tbh=%s;\r\n"+
+		"\tb=",
+		s.algorithm, s.domain, s.selector,
+		time.Now().Unix(), strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	// The signature covers the signed headers and its own header with
+	// an empty b= tag, without the final CRLF
+	canonicalHeaders.WriteString(strings.TrimSuffix(relaxedHeader(signature), "\r\n"))
+	hash := sha256.Sum256([]byte(canonicalHeaders.String()))
+
+	var sig []byte
+	var err error
+	if s.algorithm == "ed25519-sha256" {
+		sig, err = s.key.Sign(rand.Reader, hash[:], crypto.Hash(0))
+	} else {
+		sig, err = s.key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign message: %w", err)
+	}
+
+	var out bytes.Buffer
+	out.WriteString(signature)
+	encoded := base64.StdEncoding.EncodeToString(sig)
+	for len(encoded) > 72 {
+		out.WriteString(encoded[:72] + "\r\n\t")
+		encoded = encoded[72:]
+	}
+	out.WriteString(encoded + "\r\n")
+	out.Write(toCRLF(header))
+	out.WriteString("\r\n\r\n")
+	out.Write(toCRLF(body))
+	return out.Bytes(), nil
+}
+
+// parseHeader returns the fields of a header by lowercase name, with their
+// continuation lines. Of repeated fields, the last one is kept, which is the
+// one a verifier picks first.
+func parseHeader(header string) map[string]string {
+	fields := map[string]string{}
+	lines := strings.SplitAfter(strings.ReplaceAll(header, "\r\n", "\n"), "\n")
+
+	var current string
+	flush := func() {
+		if name, _, ok := strings.Cut(current, ":"); ok {
+			fields[strings.ToLower(strings.TrimSpace(name))] = current
+		}
+	}
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			current += line
+			continue
+		}
+		flush()
+		current = line
+	}
+	flush()
+	return fields
+}
+
+// relaxedHeader canonicalizes a header field with its continuation lines
+// (RFC 6376 section 3.4.2)
+func relaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + value + "\r\n"
+}
+
+// relaxedBody canonicalizes the body (RFC 6376 section 3.4.4)
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimRight(line, " \t")
+		fields := strings.FieldsFunc(trimmed, isWSP)
+		if len(trimmed) > 0 && isWSP(rune(trimmed[0])) {
+			lines[i] = " " + strings.Join(fields, " ")
+		} else {
+			lines[i] = strings.Join(fields, " ")
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// toCRLF turns lone LF line endings into CRLF, as they are sent
+func toCRLF(content []byte) []byte {
+	return bytes.ReplaceAll(bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+}
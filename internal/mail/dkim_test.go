@@ -0,0 +1,338 @@
+package mail
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRelaxedHeader(t *testing.T) {
+	tests := []struct {
+		field, want string
+	}{
+		// RFC 6376 section 3.4.5
+		{"A: X\r\n", "a:X\r\n"},
+		{"B : Y\t\r\n\tZ  \r\n", "b:Y Z\r\n"},
+
+		{"Subject:  Is   dinner ready?  \r\n", "subject:Is dinner ready?\r\n"},
+		{"Message-ID:<id@example.org>\n", "message-id:<id@example.org>\r\n"},
+		{"To: a@example.org,\r\n b@example.org\r\n", "to:a@example.org, b@example.org\r\n"},
+		{"X-Empty:\r\n", "x-empty:\r\n"},
+	}
+	for _, tt := range tests {
+		if got := relaxedHeader(tt.field); got != tt.want {
+			t.Errorf("relaxedHeader(%q) = %q, want %q", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestRelaxedBody(t *testing.T) {
+	tests := []struct {
+		body, want string
+	}{
+		// RFC 6376 section 3.4.5
+		{" C \r\nD \t E\r\n\r\n\r\n", " C\r\nD E\r\n"},
+
+		{"", ""},
+		{"\r\n\r\n", ""},
+		{"no newline", "no newline\r\n"},
+		{"lf \nonly\n\n", "lf\r\nonly\r\n"},
+		{"\tindented\r\n", " indented\r\n"},
+		{"a\r\n\r\nb\r\n", "a\r\n\r\nb\r\n"},
+	}
+	for _, tt := range tests {
+		if got := string(relaxedBody([]byte(tt.body))); got != tt.want {
+			t.Errorf("relaxedBody(%q) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+// rfc8463Seed is the Ed25519 key of the example in RFC 8463 appendix A,
+// published as brisbane._domainkey.football.example.com
+const (
+	rfc8463Seed      = "nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A="
+	rfc8463PublicKey = "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+)
+
+// rfc8463Message is the example message of RFC 8463 appendix A.3, with its
+// Ed25519 signature
+const rfc8463Message = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+func rfc8463Key(t *testing.T) (ed25519.PrivateKey, ed25519.PublicKey) {
+	t.Helper()
+	seed, err := base64.StdEncoding.DecodeString(rfc8463Seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := base64.StdEncoding.DecodeString(rfc8463PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ed25519.NewKeyFromSeed(seed), ed25519.PublicKey(public)
+}
+
+// TestVerifyRFC8463 checks the canonicalization against the signed example
+// of RFC 8463, which also checks verifyDKIM used by the other tests
+func TestVerifyRFC8463(t *testing.T) {
+	key, public := rfc8463Key(t)
+	if !public.Equal(key.Public()) {
+		t.Fatal("public key does not match the private key")
+	}
+	if err := verifyDKIM([]byte(rfc8463Message), public); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := strings.Replace(rfc8463Message, "Is dinner ready?", "Is dinner  ready?", 1)
+	if err := verifyDKIM([]byte(tampered), public); err != nil {
+		t.Errorf("relaxed canonicalization should ignore extra whitespace: %v", err)
+	}
+	tampered = strings.Replace(rfc8463Message, "Is dinner ready?", "Is lunch ready?", 1)
+	if err := verifyDKIM([]byte(tampered), public); err == nil {
+		t.Error("changed subject verified")
+	}
+}
+
+func TestDKIMSignRoundTrip(t *testing.T) {
+	rfcKey, _ := rfc8463Key(t)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		key       crypto.Signer
+		pkcs1     bool
+		algorithm string
+	}{
+		{"rfc 8463 ed25519", rfcKey, false, "ed25519-sha256"},
+		{"ed25519", edKey, false, "ed25519-sha256"},
+		{"rsa pkcs1", rsaKey, true, "rsa-sha256"},
+		{"rsa pkcs8", rsaKey, false, "rsa-sha256"},
+	}
+
+	// Header and body as built by buildMessage, LF endings are signed as CRLF
+	message := "From: Joe SixPack <joe@football.example.com>\r\n" +
+		"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+		"Subject: Is dinner ready?\r\n" +
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700\r\n" +
+		"X-Unsigned: anything\r\n" +
+		"\r\n" +
+		"Hi.\n\nWe lost the game.  Are you hungry yet?\n\nJoe.\n"
+
+	for _, tt := range tests {
+		signer, err := NewDKIMSigner("football.example.com", "brisbane", writeTestKey(t, tt.key, tt.pkcs1))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		signed, err := signer.Sign([]byte(message))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !strings.Contains(string(signed), "a="+tt.algorithm+";") {
+			t.Errorf("%s: signature does not use %s", tt.name, tt.algorithm)
+		}
+		if !strings.Contains(string(signed), "h=from:to:subject:date;") {
+			t.Errorf("%s: unexpected signed headers in %q", tt.name, signed)
+		}
+		if err := verifyDKIM(signed, tt.key.Public()); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		// The unsigned header may change, the body may not
+		changed := strings.Replace(string(signed), "anything", "something else", 1)
+		if err := verifyDKIM([]byte(changed), tt.key.Public()); err != nil {
+			t.Errorf("%s: changed unsigned header: %v", tt.name, err)
+		}
+		changed = strings.Replace(string(signed), "We lost", "We won", 1)
+		if err := verifyDKIM([]byte(changed), tt.key.Public()); err == nil {
+			t.Errorf("%s: changed body verified", tt.name)
+		}
+	}
+}
+
+func TestDKIMSignErrors(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewDKIMSigner("example.org", "sel", writeTestKey(t, key, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []string{
+		"From: a@example.org\r\nSubject: no body",
+		"Subject: no from\r\n\r\nbody\r\n",
+	}
+	for _, message := range tests {
+		if _, err := signer.Sign([]byte(message)); err == nil {
+			t.Errorf("Sign(%q) did not fail", message)
+		}
+	}
+}
+
+func TestDKIMDNSRecord(t *testing.T) {
+	key, _ := rfc8463Key(t)
+	signer, err := NewDKIMSigner("football.example.com", "brisbane", writeTestKey(t, key, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// RFC 8463 appendix A.2
+	name, record, err := signer.DNSRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "brisbane._domainkey.football.example.com"; name != want {
+		t.Errorf("DNS name = %q, want %q", name, want)
+	}
+	if want := "v=DKIM1; k=ed25519; p=" + rfc8463PublicKey; record != want {
+		t.Errorf("DNS record = %q, want %q", record, want)
+	}
+}
+
+// writeTestKey stores the key as a PEM file, in PKCS #1 form for RSA keys
+// if pkcs1 is set and in PKCS #8 form otherwise
+func writeTestKey(t *testing.T, key crypto.Signer, pkcs1 bool) string {
+	t.Helper()
+	block := &pem.Block{Type: "PRIVATE KEY"}
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok && pkcs1 {
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}
+	} else {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.Bytes = der
+	}
+
+	path := filepath.Join(t.TempDir(), "dkim.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+var signatureValue = regexp.MustCompile(`(;\s*b\s*=)[^;]*`)
+
+// verifyDKIM checks the first DKIM-Signature of a message as a receiver
+// would: the body hash, and the signature over the signed header fields,
+// picked from the bottom up, and the signature field without its b= value
+func verifyDKIM(message []byte, key crypto.PublicKey) error {
+	header, body, found := strings.Cut(string(message), "\r\n\r\n")
+	if !found {
+		return errors.New("no body")
+	}
+
+	var fields []string
+	for _, line := range strings.Split(header, "\r\n") {
+		if len(fields) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	fieldName := func(field string) string {
+		name, _, _ := strings.Cut(field, ":")
+		return strings.ToLower(strings.TrimSpace(name))
+	}
+
+	signature := ""
+	for _, field := range fields {
+		if fieldName(field) == "dkim-signature" {
+			signature = field
+			break
+		}
+	}
+	if signature == "" {
+		return errors.New("no DKIM-Signature")
+	}
+
+	tags := map[string]string{}
+	_, value, _ := strings.Cut(signature, ":")
+	for _, tag := range strings.Split(value, ";") {
+		name, value, _ := strings.Cut(tag, "=")
+		tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(value), "")
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody([]byte(body)))
+	if got := base64.StdEncoding.EncodeToString(bodyHash[:]); got != tags["bh"] {
+		return fmt.Errorf("body hash %s, signed %s", got, tags["bh"])
+	}
+
+	var signed strings.Builder
+	used := map[string]int{}
+	for _, name := range strings.Split(strings.ToLower(tags["h"]), ":") {
+		seen := 0
+		for i := len(fields) - 1; i >= 0; i-- {
+			if fieldName(fields[i]) != name {
+				continue
+			}
+			if seen == used[name] {
+				signed.WriteString(relaxedHeader(fields[i] + "\r\n"))
+				break
+			}
+			seen++
+		}
+		used[name]++
+	}
+	unsigned := signatureValue.ReplaceAllString(signature, "$1")
+	signed.WriteString(strings.TrimSuffix(relaxedHeader(unsigned+"\r\n"), "\r\n"))
+	hash := sha256.Sum256([]byte(signed.String()))
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" || !ed25519.Verify(key, hash[:], sig) {
+			return errors.New("ed25519 signature does not verify")
+		}
+	case *rsa.PublicKey:
+		if tags["a"] != "rsa-sha256" {
+			return fmt.Errorf("unexpected algorithm %s", tags["a"])
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig); err != nil {
+			return fmt.Errorf("rsa signature does not verify: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported key %T", key)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	outboxPollInterval = 10 * time.Second
+	outboxBatchSize    = 20
+	outboxSendTimeout  = 30 * time.Second
+	outboxMaxAttempts  = 8
+	outboxRetryDelay   = 30 * time.Second // Doubled after every failed attempt
+)
+
+// Message is a mail waiting in the outbox
+type Message struct {
+	ID       int64
+	To       []string
+	Content  Content
+	Attempts int       // Failed attempts so far
+	Queued   time.Time // When Send stored the mail
+
+	// Verification code the mail carries and the key it was issued to, if
+	// any. Fail drops that code when the mail is given up on.
+	Fingerprint string
+	Code        string
+}
+
+// OutboxStore persists the messages of an outbox
+type OutboxStore interface {
+	Enqueue(msg Message) error
+	// Due returns up to limit messages whose next attempt is before now
+	Due(now time.Time, limit int) ([]Message, error)
+	// Retry counts a failed attempt and schedules the next one
+	Retry(msg Message, next time.Time, sendErr error) error
+	Delete(id int64) error
+	// Fail gives up on the message and records the failure, along with the
+	// verification code it carries
+	Fail(msg Message, sendErr error) error
+}
+
+// Outbox is a MailSender that stores mails and sends them in the background
+// with another MailSender, retrying failed sends with exponential backoff.
+// If that sender is an io.Closer, it is closed after every round of sends so
+// it can keep a connection open for a batch.
+type Outbox struct {
+	sender    MailSender
+	store     OutboxStore
+	templates *Templates
+	maxAge    time.Duration   // Retries stop before mails get older, 0 for no limit
+	ctx       context.Context // Canceled by Stop to interrupt a send
+	cancel    context.CancelFunc
+	wake      chan struct{}
+	done      chan struct{} // Closed when the worker goroutine has returned
+}
+
+// NewOutbox starts sending the stored mails. A mail is given up on rather
+// than retried past maxAge after it was queued, such as when the code it
+// carries has expired by then; zero keeps retrying up to the attempt limit.
+func NewOutbox(sender MailSender, store OutboxStore, templates *Templates, maxAge time.Duration) *Outbox {
+	ctx, cancel := context.WithCancel(context.Background())
+	o := &Outbox{
+		sender:    sender,
+		store:     store,
+		templates: templates,
+		maxAge:    maxAge,
+		ctx:       ctx,
+		cancel:    cancel,
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+
+	go o.run()
+
+	return o
+}
+
+// Send queues the mail. It returns once the mail is stored, ctx is unused.
+func (o *Outbox) Send(ctx context.Context, to []string, content Content) error {
+	return o.enqueue(Message{To: to, Content: content})
+}
+
+// enqueue stores the message and wakes up the worker
+func (o *Outbox) enqueue(msg Message) error {
+	err := o.store.Enqueue(msg)
+	if err != nil {
+		return fmt.Errorf("failed to queue mail: %w", err)
+	}
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SendConfirmation queues a confirmation email with the provided confirmation number
+func (o *Outbox) SendConfirmation(ctx context.Context, to, confirmationNumber, keyFingerprint, lang string) error {
+	content, err := o.templates.Confirmation(confirmationNumber, keyFingerprint, lang)
+	if err != nil {
+		return err
+	}
+	return o.enqueue(Message{
+		To:          []string{to},
+		Content:     content,
+		Fingerprint: keyFingerprint,
+		Code:        confirmationNumber,
+	})
+}
+
+// Stop shuts down the worker. A send in progress is interrupted and
+// retried on the next start, without counting as a failed attempt.
+func (o *Outbox) Stop() {
+	o.cancel()
+	<-o.done
+}
+
+// run sends the due messages when woken up by Send and periodically, to
+// pick up retries and mails left over from a previous run
+func (o *Outbox) run() {
+	defer close(o.done)
+
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		o.flush()
+		if closer, ok := o.sender.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Printf("Error closing mail sender: %v", err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-o.wake:
+		case <-o.ctx.Done():
+			return
+		}
+	}
+}
+
+// flush sends the due messages, batch by batch
+func (o *Outbox) flush() {
+	for o.ctx.Err() == nil {
+		messages, err := o.store.Due(time.Now(), outboxBatchSize)
+		if err != nil {
+			log.Printf("Error loading mail outbox: %v", err)
+			return
+		}
+
+		for _, msg := range messages {
+			if o.ctx.Err() != nil {
+				return
+			}
+			o.deliver(msg)
+		}
+
+		if len(messages) < outboxBatchSize {
+			return
+		}
+	}
+}
+
+// deliver makes one attempt at sending the message and updates the store
+func (o *Outbox) deliver(msg Message) {
+	ctx, cancel := context.WithTimeout(o.ctx, outboxSendTimeout)
+	defer cancel()
+
+	sendErr := o.sender.Send(ctx, msg.To, msg.Content)
+	if sendErr != nil && o.ctx.Err() != nil {
+		return
+	}
+
+	var err error
+	recipients := strings.Join(msg.To, ", ")
+	attempt := msg.Attempts + 1
+	delay := outboxRetryDelay << msg.Attempts
+	next := time.Now().Add(delay)
+	switch {
+	case sendErr == nil:
+		err = o.store.Delete(msg.ID)
+	case attempt >= outboxMaxAttempts:
+		log.Printf("Giving up on mail to %s after %d attempts: %v", recipients, attempt, sendErr)
+		err = o.store.Fail(msg, sendErr)
+	case o.maxAge > 0 && next.After(msg.Queued.Add(o.maxAge)):
+		log.Printf("Giving up on mail to %s after %d attempts, it would be too old to retry: %v", recipients, attempt, sendErr)
+		err = o.store.Fail(msg, sendErr)
+	default:
+		log.Printf("Mail to %s failed (attempt %d/%d), retrying in %s: %v",
+			recipients, attempt, outboxMaxAttempts, delay, sendErr)
+		err = o.store.Retry(msg, next, sendErr)
+	}
+
+	if err != nil {
+		log.Printf("Error updating mail outbox: %v", err)
+	}
+}
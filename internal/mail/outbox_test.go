@@ -0,0 +1,67 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// recordingStore keeps what deliver did with the last message
+type recordingStore struct {
+	deleted, failed bool
+	next            time.Time
+}
+
+func (s *recordingStore) Enqueue(msg Message) error                       { return nil }
+func (s *recordingStore) Due(now time.Time, limit int) ([]Message, error) { return nil, nil }
+func (s *recordingStore) Delete(id int64) error                           { s.deleted = true; return nil }
+func (s *recordingStore) Fail(msg Message, sendErr error) error           { s.failed = true; return nil }
+func (s *recordingStore) Retry(msg Message, next time.Time, sendErr error) error {
+	s.next = next
+	return nil
+}
+
+type failingSender struct{ err error }
+
+func (f failingSender) Send(ctx context.Context, to []string, content Content) error { return f.err }
+func (f failingSender) SendConfirmation(ctx context.Context, to, code, fingerprint, lang string) error {
+	return f.err
+}
+
+func TestOutboxDeliver(t *testing.T) {
+	tests := []struct {
+		name     string
+		sendErr  error
+		attempts int
+		age      time.Duration // Since the mail was queued
+		maxAge   time.Duration
+		want     string
+	}{
+		{"sent", nil, 0, 0, time.Hour, "deleted"},
+		{"first failure", errors.New("down"), 0, 0, time.Hour, "retried"},
+		{"last attempt", errors.New("down"), outboxMaxAttempts - 1, 0, 0, "failed"},
+		{"no age limit", errors.New("down"), 6, 40 * time.Minute, 0, "retried"},
+		// The 7th retry would come 32 minutes later, past the hour
+		{"too old to retry", errors.New("down"), 6, 40 * time.Minute, time.Hour, "failed"},
+		{"young enough", errors.New("down"), 6, 20 * time.Minute, time.Hour, "retried"},
+	}
+	for _, tt := range tests {
+		store := &recordingStore{}
+		o := &Outbox{sender: failingSender{tt.sendErr}, store: store, maxAge: tt.maxAge, ctx: context.Background()}
+		o.deliver(Message{ID: 1, To: []string{"a@example.org"}, Attempts: tt.attempts, Queued: time.Now().Add(-tt.age)})
+
+		got := "retried"
+		switch {
+		case store.deleted:
+			got = "deleted"
+		case store.failed:
+			got = "failed"
+		case store.next.IsZero():
+			got = "nothing"
+		}
+		if got != tt.want {
+			t.Errorf("%s: mail %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -14,11 +14,12 @@ type ResendMailSender struct {
 	client    *resend.Client
 	fromEmail string
 	fromName  string
+	templates *Templates
 }
 
 // NewResendMailSender creates a new ResendMailSender instance
 // keyPath is the path to the file containing the Resend API key
-func NewResendMailSender(keyPath string, fromEmail string, fromName string) (MailSender, error) {
+func NewResendMailSender(keyPath string, fromEmail string, fromName string, templates *Templates) (MailSender, error) {
 	content, err := os.ReadFile(keyPath)
 	if err != nil {
 		return nil, fmt.Errorf("cannot load resend api key: %w", err)
@@ -32,32 +33,25 @@ func NewResendMailSender(keyPath string, fromEmail string, fromName string) (Mai
 		client:    resend.NewClient(apiKey),
 		fromEmail: fromEmail,
 		fromName:  fromName,
+		templates: templates,
 	}, nil
 }
 
-func (m *ResendMailSender) Send(ctx context.Context, to []string, subject, html string) error {
+func (m *ResendMailSender) Send(ctx context.Context, to []string, content Content) error {
 	fromField := fmt.Sprintf("%s <%s>", m.fromName, m.fromEmail)
 
 	params := &resend.SendEmailRequest{
 		From:    fromField,
 		To:      to,
-		Subject: subject,
-		Html:    html,
+		Subject: content.Subject,
+		Text:    content.Text,
+		Html:    content.HTML,
 	}
 	_, err := m.client.Emails.Send(params)
 	return err
 }
 
 // SendConfirmation sends a confirmation email with the provided confirmation number
-func (m *ResendMailSender) SendConfirmation(ctx context.Context, to, confirmationNumber, keyFingerprint string) error {
-	to_list := []string{to}
-	subject := fmt.Sprintf("Complete KeyPub.sh Registration for Key %s...", keyFingerprint)
-	htmlContent := fmt.Sprintf(confirmationMailTemplate, keyFingerprint, confirmationNumber, confirmationNumber)
-
-	err := m.Send(ctx, to_list, subject, htmlContent)
-	if err != nil {
-		return fmt.Errorf("failed to send confirmation email: %w", err)
-	}
-
-	return nil
+func (m *ResendMailSender) SendConfirmation(ctx context.Context, to, confirmationNumber, keyFingerprint, lang string) error {
+	return sendConfirmation(ctx, m, m.templates, to, confirmationNumber, keyFingerprint, lang)
 }
@@ -1,103 +1,347 @@
 package mail
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	netmail "net/mail"
 	"net/smtp"
+	"net/textproto"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// TLS modes of SMTPMailSender
+const (
+	SMTPTLSImplicit = "implicit" // TLS from the start, usually port 465
+	SMTPTLSStartTLS = "starttls" // Upgraded with STARTTLS, usually port 587
+	SMTPTLSNone     = "none"     // Plain text, for local relays
+
+	// Upgraded with STARTTLS if the server offers it, plain text otherwise,
+	// as net/smtp.SendMail does
+	SMTPTLSOpportunistic = "opportunistic"
+)
+
+// Authentication mechanisms of SMTPMailSender. SMTPAuthAuto picks the first
+// of PLAIN, LOGIN and CRAM-MD5 the server offers, or none without username.
+const (
+	SMTPAuthAuto    = ""
+	SMTPAuthPlain   = "plain"
+	SMTPAuthLogin   = "login"
+	SMTPAuthCRAMMD5 = "cram-md5"
+	SMTPAuthNone    = "none"
+)
+
+const (
+	smtpConnectTimeout = 10 * time.Second
+	smtpTimeout        = 30 * time.Second
+)
+
+// SMTPOptions configures the connection of an SMTPMailSender
+type SMTPOptions struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	TLS      string // One of the SMTPTLS modes, STARTTLS if empty
+	Auth     string // One of the SMTPAuth mechanisms
+
+	// ConnectTimeout bounds connecting, TLS and authentication, Timeout the
+	// sending of one mail. Both default if zero and are cut short by the
+	// deadline of the context passed to Send.
+	ConnectTimeout time.Duration
+	Timeout        time.Duration
+
+	DKIM *DKIMSigner // Signs every mail if set
+}
+
+// SMTPMailSender sends mails through an SMTP relay. The connection is kept
+// open after a send and reused by the next one until Close is called.
 type SMTPMailSender struct {
-	host      string
-	port      int
-	username  string
-	password  string
-	secure    bool
+	options   SMTPOptions
 	fromEmail string
 	fromName  string
+	templates *Templates
+
+	mu     sync.Mutex // Serializes sends over the connection
+	conn   net.Conn   // Underlying connection of client, nil if not connected
+	client *smtp.Client
 }
 
-func NewSMTPMailSender(host string, port int, username, password string, secure bool, fromEmail, fromName string) MailSender {
+func NewSMTPMailSender(options SMTPOptions, fromEmail, fromName string, templates *Templates) (*SMTPMailSender, error) {
+	switch options.TLS {
+	case "":
+		options.TLS = SMTPTLSStartTLS
+	case SMTPTLSImplicit, SMTPTLSStartTLS, SMTPTLSOpportunistic, SMTPTLSNone:
+	default:
+		return nil, fmt.Errorf("unknown smtp tls mode: %s", options.TLS)
+	}
+	switch options.Auth {
+	case SMTPAuthAuto, SMTPAuthPlain, SMTPAuthLogin, SMTPAuthCRAMMD5, SMTPAuthNone:
+	default:
+		return nil, fmt.Errorf("unknown smtp auth mechanism: %s", options.Auth)
+	}
+	if options.ConnectTimeout <= 0 {
+		options.ConnectTimeout = smtpConnectTimeout
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = smtpTimeout
+	}
+
 	return &SMTPMailSender{
-		host:      host,
-		port:      port,
-		username:  username,
-		password:  password,
-		secure:    secure,
+		options:   options,
 		fromEmail: fromEmail,
 		fromName:  fromName,
-	}
+		templates: templates,
+	}, nil
 }
 
-func (m *SMTPMailSender) Send(ctx context.Context, to []string, subject, html string) error {
-	addr := fmt.Sprintf("%s:%d", m.host, m.port)
-	toHeader := strings.Join(to, ", ")
-	from := fmt.Sprintf("%s <%s>", m.fromName, m.fromEmail)
-	message := fmt.Sprintf(
-		"From: %s\nTo: %s\nSubject: %s\nMIME-Version: 1.0\nContent-Type: text/html; charset=\"UTF-8\"\n\n%s",
-		from, toHeader, subject, html,
-	)
-
-	if m.secure {
-		auth := smtp.PlainAuth("", m.username, m.password, m.host)
-		conn, err := tls.Dial("tcp", addr, &tls.Config{
-			ServerName: m.host,
-		})
-		if err != nil {
+func (m *SMTPMailSender) Send(ctx context.Context, to []string, content Content) error {
+	message, err := m.buildMessage(to, content)
+	if err != nil {
+		return err
+	}
+	if m.options.DKIM != nil {
+		if message, err = m.options.DKIM.Sign(message); err != nil {
 			return err
 		}
-		defer conn.Close()
+	}
 
-		client, err := smtp.NewClient(conn, m.host)
-		if err != nil {
-			return err
-		}
-		defer client.Quit() //nolint
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-		if err = client.Auth(auth); err != nil {
+	// The server may have dropped a connection kept from an earlier send
+	if m.client != nil {
+		if err := m.guarded(ctx, m.options.Timeout, m.client.Reset); err != nil {
+			m.disconnect()
+		}
+	}
+	if m.client == nil {
+		if err := m.connect(ctx); err != nil {
 			return err
 		}
+	}
 
-		if err = client.Mail(m.fromEmail); err != nil {
-			return err
+	err = m.guarded(ctx, m.options.Timeout, func() error {
+		return m.transmit(to, message)
+	})
+	if err != nil {
+		m.disconnect()
+		return err
+	}
+	return nil
+}
+
+// Close ends the kept connection, if any
+func (m *SMTPMailSender) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.client == nil {
+		return nil
+	}
+	err := m.guarded(context.Background(), m.options.Timeout, m.client.Quit)
+	m.disconnect()
+	if err != nil {
+		return fmt.Errorf("failed to quit smtp session: %w", err)
+	}
+	return nil
+}
+
+// connect dials the server, secures the connection and authenticates
+func (m *SMTPMailSender) connect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, m.options.ConnectTimeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(m.options.Host, strconv.Itoa(m.options.Port))
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	var err error
+	if m.options.TLS == SMTPTLSImplicit {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: m.tlsConfig()}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	m.conn = conn
+
+	err = m.guarded(ctx, m.options.ConnectTimeout, func() error {
+		client, err := smtp.NewClient(conn, m.options.Host)
+		if err != nil {
+			return fmt.Errorf("failed to start smtp session: %w", err)
 		}
-		for _, recipient := range to {
-			if err = client.Rcpt(recipient); err != nil {
-				return err
+		m.client = client
+
+		if m.options.TLS == SMTPTLSStartTLS || m.options.TLS == SMTPTLSOpportunistic {
+			ok, _ := client.Extension("STARTTLS")
+			if !ok && m.options.TLS == SMTPTLSStartTLS {
+				return fmt.Errorf("smtp server %s does not support STARTTLS", addr)
+			}
+			if ok {
+				if err := client.StartTLS(m.tlsConfig()); err != nil {
+					return fmt.Errorf("failed to start tls: %w", err)
+				}
 			}
 		}
 
-		writer, err := client.Data()
+		auth, err := m.auth(client)
 		if err != nil {
 			return err
 		}
-		_, err = writer.Write([]byte(message))
-		if err != nil {
-			return err
-		}
-		err = writer.Close()
-		if err != nil {
-			return err
+		if auth != nil {
+			if err := client.Auth(auth); err != nil {
+				return fmt.Errorf("failed to authenticate: %w", err)
+			}
 		}
-	} else {
-		auth := smtp.CRAMMD5Auth(m.username, m.password)
-		err := smtp.SendMail(addr, auth, m.fromEmail, to, []byte(message))
-		if err != nil {
-			return err
+		return nil
+	})
+	if err != nil {
+		m.disconnect()
+		return err
+	}
+	return nil
+}
+
+// transmit sends one mail over the connected client
+func (m *SMTPMailSender) transmit(to []string, message []byte) error {
+	if err := m.client.Mail(m.fromEmail); err != nil {
+		return fmt.Errorf("failed to set sender: %w", err)
+	}
+	for _, recipient := range to {
+		if err := m.client.Rcpt(recipient); err != nil {
+			return fmt.Errorf("failed to add recipient %s: %w", recipient, err)
 		}
 	}
+
+	writer, err := m.client.Data()
+	if err != nil {
+		return fmt.Errorf("failed to start mail data: %w", err)
+	}
+	if _, err = writer.Write(message); err != nil {
+		return fmt.Errorf("failed to write mail data: %w", err)
+	}
+	if err = writer.Close(); err != nil {
+		return fmt.Errorf("failed to send mail data: %w", err)
+	}
 	return nil
 }
-func (m *SMTPMailSender) SendConfirmation(ctx context.Context, to, confirmationNumber, keyFingerprint string) error {
-	to_list := []string{to}
-	subject := fmt.Sprintf("Complete KeyPub.sh Registration for Key %s...", keyFingerprint)
-	htmlContent := fmt.Sprintf(confirmationMailTemplate, keyFingerprint, confirmationNumber, confirmationNumber)
 
-	err := m.Send(ctx, to_list, subject, htmlContent)
+// guarded runs an exchange with the server within timeout, or until ctx is
+// done, by closing the connection. It then returns the error of ctx.
+func (m *SMTPMailSender) guarded(ctx context.Context, timeout time.Duration, exchange func() error) error {
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := m.conn.SetDeadline(deadline); err != nil {
+		return fmt.Errorf("failed to set smtp deadline: %w", err)
+	}
+
+	conn := m.conn
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	err := exchange()
+	if !stop() {
+		return fmt.Errorf("smtp exchange interrupted: %w", ctx.Err())
+	}
+	return err
+}
+
+// disconnect drops the connection without saying goodbye
+func (m *SMTPMailSender) disconnect() {
+	if m.conn != nil {
+		m.conn.Close()
+	}
+	m.conn = nil
+	m.client = nil
+}
+
+func (m *SMTPMailSender) tlsConfig() *tls.Config {
+	return &tls.Config{ServerName: m.options.Host}
+}
+
+// SendConfirmation sends a confirmation email with the provided confirmation number
+func (m *SMTPMailSender) SendConfirmation(ctx context.Context, to, confirmationNumber, keyFingerprint, lang string) error {
+	return sendConfirmation(ctx, m, m.templates, to, confirmationNumber, keyFingerprint, lang)
+}
+
+// buildMessage formats the mail as multipart/alternative. The plain text
+// part comes first, clients show the last part they support.
+func (m *SMTPMailSender) buildMessage(to []string, content Content) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain", content.Text},
+		{"text/html", content.HTML},
+	} {
+		if part.content == "" {
+			continue
+		}
+
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType+`; charset="UTF-8"`)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		writer, err := parts.CreatePart(header)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create mail part: %w", err)
+		}
+
+		encoder := quotedprintable.NewWriter(writer)
+		if _, err := encoder.Write([]byte(part.content)); err != nil {
+			return nil, fmt.Errorf("failed to encode mail part: %w", err)
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, fmt.Errorf("failed to encode mail part: %w", err)
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close mail parts: %w", err)
+	}
+
+	messageID, err := m.messageID()
 	if err != nil {
-		return fmt.Errorf("failed to send confirmation email: %w", err)
+		return nil, err
 	}
 
-	return nil
+	from := netmail.Address{Name: m.fromName, Address: m.fromEmail}
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", from.String())
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", content.Subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Message-ID: %s\r\n", messageID)
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/alternative; boundary=%q\r\n", parts.Boundary())
+	fmt.Fprintf(&message, "\r\n")
+	message.Write(body.Bytes())
+
+	return message.Bytes(), nil
+}
+
+// messageID returns a random Message-ID in the domain of the sender
+func (m *SMTPMailSender) messageID() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to generate message id: %w", err)
+	}
+
+	domain := m.options.Host
+	if at := strings.LastIndex(m.fromEmail, "@"); at >= 0 {
+		domain = m.fromEmail[at+1:]
+	}
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(random), domain), nil
 }
@@ -0,0 +1,100 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// auth returns the configured authentication for the session, nil for none
+func (m *SMTPMailSender) auth(client *smtp.Client) (smtp.Auth, error) {
+	mechanism := m.options.Auth
+	if mechanism == SMTPAuthAuto {
+		if m.options.Username == "" {
+			return nil, nil
+		}
+		_, encrypted := client.TLSConnectionState()
+		var err error
+		if mechanism, err = pickAuth(client, encrypted || isLocalhost(m.options.Host)); err != nil {
+			return nil, err
+		}
+	}
+
+	switch mechanism {
+	case SMTPAuthPlain:
+		return smtp.PlainAuth("", m.options.Username, m.options.Password, m.options.Host), nil
+	case SMTPAuthLogin:
+		return &loginAuth{username: m.options.Username, password: m.options.Password, host: m.options.Host}, nil
+	case SMTPAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(m.options.Username, m.options.Password), nil
+	default:
+		return nil, nil
+	}
+}
+
+// pickAuth returns the first mechanism offered by the server, preferring
+// PLAIN and LOGIN when the password may be sent in the clear, which is over
+// TLS or to localhost. Otherwise only CRAM-MD5, which does not send it, is
+// picked, as PLAIN and LOGIN would refuse to authenticate.
+func pickAuth(client *smtp.Client, cleartext bool) (string, error) {
+	ok, offered := client.Extension("AUTH")
+	if !ok {
+		return "", errors.New("smtp server does not support authentication, set auth to none")
+	}
+
+	candidates := []string{SMTPAuthCRAMMD5}
+	if cleartext {
+		candidates = []string{SMTPAuthPlain, SMTPAuthLogin, SMTPAuthCRAMMD5}
+	}
+	mechanisms := strings.Fields(strings.ToUpper(offered))
+	for _, mechanism := range candidates {
+		for _, candidate := range mechanisms {
+			if candidate == strings.ToUpper(mechanism) {
+				return mechanism, nil
+			}
+		}
+	}
+	if !cleartext {
+		return "", fmt.Errorf("no smtp auth mechanism usable without tls in: %s", offered)
+	}
+	return "", fmt.Errorf("no supported smtp auth mechanism in: %s", offered)
+}
+
+// loginAuth implements the LOGIN mechanism, which net/smtp lacks. Like
+// smtp.PlainAuth it refuses to send the password unencrypted, except to
+// localhost.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	challenge := strings.ToLower(strings.TrimSpace(string(fromServer)))
+	switch {
+	case strings.HasPrefix(challenge, "user"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(challenge, "pass"):
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge: %q", fromServer)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
@@ -0,0 +1,165 @@
+package mail
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+
+	"keypub/internal/i18n"
+)
+
+//go:embed templates
+var defaultTemplates embed.FS
+
+// ConfirmationData is what the confirmation templates are executed with
+type ConfirmationData struct {
+	Host        string // Name users connect to with ssh
+	Fingerprint string
+	Code        string
+}
+
+// Templates renders the mails. The text template also defines the subject,
+// as a template named "subject". Templates translate text with the t
+// function, {{t "Hello %s" .Name}}, into the language they are rendered in.
+type Templates struct {
+	host string
+	text map[string]*texttemplate.Template // By language
+	html map[string]*htmltemplate.Template
+}
+
+// LoadTemplates loads confirmation.txt and confirmation.html from dir,
+// falling back to the embedded defaults for files that are not there or if
+// dir is empty. host is the server name the mails tell users to connect to.
+func LoadTemplates(dir, host string) (*Templates, error) {
+	text, err := readTemplate(dir, "confirmation.txt")
+	if err != nil {
+		return nil, err
+	}
+	html, err := readTemplate(dir, "confirmation.html")
+	if err != nil {
+		return nil, err
+	}
+
+	// Parsed once with a placeholder t, then cloned for every language
+	textTemplate, err := texttemplate.New("confirmation.txt").
+		Funcs(texttemplate.FuncMap{"t": translator(i18n.DefaultLang)}).
+		Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse text template: %w", err)
+	}
+	if textTemplate.Lookup("subject") == nil {
+		return nil, fmt.Errorf("text template does not define a subject")
+	}
+	htmlTemplate, err := htmltemplate.New("confirmation.html").
+		Funcs(htmltemplate.FuncMap{"t": translator(i18n.DefaultLang)}).
+		Parse(html)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse html template: %w", err)
+	}
+
+	t := &Templates{
+		host: host,
+		text: map[string]*texttemplate.Template{},
+		html: map[string]*htmltemplate.Template{},
+	}
+	for _, lang := range i18n.Languages() {
+		if t.text[lang], err = textTemplate.Clone(); err != nil {
+			return nil, fmt.Errorf("failed to clone text template: %w", err)
+		}
+		t.text[lang].Funcs(texttemplate.FuncMap{"t": translator(lang)})
+
+		if t.html[lang], err = htmlTemplate.Clone(); err != nil {
+			return nil, fmt.Errorf("failed to clone html template: %w", err)
+		}
+		t.html[lang].Funcs(htmltemplate.FuncMap{"t": translator(lang)})
+	}
+
+	// Render once so a template referring to unknown fields fails here
+	// rather than on the first registration
+	for _, lang := range i18n.Languages() {
+		if _, err := t.Confirmation("00000000", "SHA256:...", lang); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// translator returns the t function of templates in lang
+func translator(lang string) func(string, ...any) string {
+	return func(msg string, args ...any) string {
+		return i18n.Sprintf(lang, msg, args...)
+	}
+}
+
+// readTemplate returns the file from dir, or the embedded default
+func readTemplate(dir, name string) (string, error) {
+	if dir != "" {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return string(content), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("failed to read template: %w", err)
+		}
+	}
+
+	content, err := defaultTemplates.ReadFile("templates/" + name)
+	if err != nil {
+		return "", fmt.Errorf("failed to read default template: %w", err)
+	}
+	return string(content), nil
+}
+
+// Confirmation renders the mail with the code confirming the fingerprint, in
+// lang or in the default language if lang is not supported
+func (t *Templates) Confirmation(confirmationNumber, keyFingerprint, lang string) (Content, error) {
+	text, ok := t.text[lang]
+	if !ok {
+		lang = i18n.DefaultLang
+		text = t.text[lang]
+	}
+	html := t.html[lang]
+
+	data := ConfirmationData{
+		Host:        t.host,
+		Fingerprint: keyFingerprint,
+		Code:        confirmationNumber,
+	}
+
+	var subjectOut, textOut, htmlOut strings.Builder
+	if err := text.ExecuteTemplate(&subjectOut, "subject", data); err != nil {
+		return Content{}, fmt.Errorf("failed to render subject: %w", err)
+	}
+	if err := text.Execute(&textOut, data); err != nil {
+		return Content{}, fmt.Errorf("failed to render text template: %w", err)
+	}
+	if err := html.Execute(&htmlOut, data); err != nil {
+		return Content{}, fmt.Errorf("failed to render html template: %w", err)
+	}
+
+	return Content{
+		Subject: strings.TrimSpace(subjectOut.String()),
+		Text:    textOut.String(),
+		HTML:    htmlOut.String(),
+	}, nil
+}
+
+// sendConfirmation renders the confirmation mail and sends it with sender
+func sendConfirmation(ctx context.Context, sender MailSender, templates *Templates, to, confirmationNumber, keyFingerprint, lang string) error {
+	content, err := templates.Confirmation(confirmationNumber, keyFingerprint, lang)
+	if err != nil {
+		return err
+	}
+
+	if err := sender.Send(ctx, []string{to}, content); err != nil {
+		return fmt.Errorf("failed to send confirmation email: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package ratelimit
+
+import "net"
+
+// ipv6PrefixBits is the prefix length IPv6 clients are grouped by. A single
+// host usually gets a whole /64, so limiting single addresses would be useless.
+const ipv6PrefixBits = 64
+
+// RemoteIP returns the IP address of a remote address, or nil if it has none
+func RemoteIP(addr net.Addr) net.IP {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// IPClientID returns the client ID of a remote address for per-IP limiting.
+// IPv4 addresses are used as is, IPv6 addresses are reduced to their /64.
+func IPClientID(addr net.Addr) string {
+	ip := RemoteIP(addr)
+	if ip == nil {
+		return addr.String()
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	prefix := net.IPNet{IP: ip.Mask(net.CIDRMask(ipv6PrefixBits, 128)), Mask: net.CIDRMask(ipv6PrefixBits, 128)}
+	return prefix.String()
+}
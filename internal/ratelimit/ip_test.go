@@ -0,0 +1,40 @@
+package ratelimit
+
+import (
+	"net"
+	"testing"
+)
+
+// stringAddr is a remote address that is not a *net.TCPAddr
+type stringAddr string
+
+func (a stringAddr) Network() string { return "test" }
+func (a stringAddr) String() string  { return string(a) }
+
+func TestIPClientID(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}, "192.0.2.1"},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 22}, "192.0.2.2"},
+		// IPv4-mapped IPv6 addresses are limited as IPv4
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 22}, "192.0.2.1"},
+
+		// Every address of a /64 shares one client ID
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:3:4:5:6"), Port: 2222}, "2001:db8:1:2::/64"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8:1:2::9"), Port: 1}, "2001:db8:1:2::/64"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8:1:3::9"), Port: 1}, "2001:db8:1:3::/64"},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 22}, "::/64"},
+
+		{stringAddr("192.0.2.1:22"), "192.0.2.1"},
+		{stringAddr("[2001:db8:1:2::9]:22"), "2001:db8:1:2::/64"},
+		{stringAddr("2001:db8:1:2::9"), "2001:db8:1:2::/64"},
+		{stringAddr("pipe"), "pipe"},
+	}
+	for _, tt := range tests {
+		if got := IPClientID(tt.addr); got != tt.want {
+			t.Errorf("IPClientID(%s) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -2,14 +2,16 @@
 package ratelimit
 
 import (
+	"log"
 	"math"
 	"sync"
 	"time"
 )
 
 const (
-	cost             = 1.0
+	DefaultCost      = 1.0
 	cleanupThreshold = 3 // multiplier for period to determine staleness
+	snapshotInterval = time.Minute
 )
 
 // Result represents the outcome of a rate limit check
@@ -24,6 +26,19 @@ type Client struct {
 	rate float64   // Current rate
 }
 
+// ClientState is the state of a client as kept by a Store
+type ClientState struct {
+	ID   string
+	Time time.Time
+	Rate float64
+}
+
+// Store persists the state of a rate limiter across restarts
+type Store interface {
+	Load() ([]ClientState, error)
+	Save(clients []ClientState) error // Replaces the saved state
+}
+
 // RateLimiter manages rate limiting for multiple clients
 type RateLimiter struct {
 	mu      sync.Mutex
@@ -31,17 +46,27 @@ type RateLimiter struct {
 	limit   float64       // Rate limit threshold for all clients
 	period  time.Duration // Time period for rate calculation
 	stop    chan struct{} // Channel to signal stopping the cleanup goroutine
+	done    chan struct{} // Closed when the cleanup goroutine has returned
 	strict  bool          // Whether to update rate for denied requests
+	store   Store         // Optional, keeps the state across restarts
 }
 
-// NewRateLimiter creates a new rate limiter with a specified limit and period
-func NewRateLimiter(limit float64, period time.Duration, strict bool) *RateLimiter {
+// NewRateLimiter creates a new rate limiter with a specified limit and period.
+// With a store, the saved state is restored and snapshots are saved
+// periodically and on Stop.
+func NewRateLimiter(limit float64, period time.Duration, strict bool, store Store) *RateLimiter {
 	rl := &RateLimiter{
 		clients: make(map[string]*Client),
 		limit:   limit,
 		period:  period,
 		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
 		strict:  strict,
+		store:   store,
+	}
+
+	if store != nil {
+		rl.restore()
 	}
 
 	// Start cleanup goroutine
@@ -50,26 +75,78 @@ func NewRateLimiter(limit float64, period time.Duration, strict bool) *RateLimit
 	return rl
 }
 
-// Stop gracefully shuts down the rate limiter and its cleanup goroutine
+// Stop gracefully shuts down the rate limiter and its cleanup goroutine,
+// saving a last snapshot
 func (rl *RateLimiter) Stop() {
 	close(rl.stop)
+	<-rl.done
+	rl.snapshot()
 }
 
-// cleanupLoop runs the cleanup function periodically
+// cleanupLoop runs the cleanup and snapshot functions periodically
 func (rl *RateLimiter) cleanupLoop() {
+	defer close(rl.done)
+
 	ticker := time.NewTicker(rl.period)
 	defer ticker.Stop()
 
+	var snapshots <-chan time.Time
+	if rl.store != nil {
+		snapshotTicker := time.NewTicker(snapshotInterval)
+		defer snapshotTicker.Stop()
+		snapshots = snapshotTicker.C
+	}
+
 	for {
 		select {
 		case <-ticker.C:
 			rl.cleanup()
+		case <-snapshots:
+			rl.snapshot()
 		case <-rl.stop:
 			return
 		}
 	}
 }
 
+// restore loads the saved state, skipping clients that are already stale
+func (rl *RateLimiter) restore() {
+	clients, err := rl.store.Load()
+	if err != nil {
+		log.Printf("Error restoring rate limiter state: %v", err)
+		return
+	}
+
+	threshold := time.Now().Add(-rl.period * cleanupThreshold)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, client := range clients {
+		if client.Time.Before(threshold) {
+			continue
+		}
+		rl.clients[client.ID] = &Client{time: client.Time, rate: client.Rate}
+	}
+}
+
+// snapshot saves the current state to the store
+func (rl *RateLimiter) snapshot() {
+	if rl.store == nil {
+		return
+	}
+
+	rl.mu.Lock()
+	clients := make([]ClientState, 0, len(rl.clients))
+	for id, client := range rl.clients {
+		clients = append(clients, ClientState{ID: id, Time: client.time, Rate: client.rate})
+	}
+	rl.mu.Unlock()
+
+	if err := rl.store.Save(clients); err != nil {
+		log.Printf("Error saving rate limiter state: %v", err)
+	}
+}
+
 // cleanup removes stale clients
 func (rl *RateLimiter) cleanup() {
 	rl.mu.Lock()
@@ -92,8 +169,9 @@ func (rl *RateLimiter) calculateNextAllowedTime(now time.Time, rate float64) tim
 	return now.Add(waitDuration)
 }
 
-// Check determines if a request can proceed under rate limits
-func (rl *RateLimiter) Check(clientID string) Result {
+// Check determines if a request of the given cost can proceed under rate
+// limits. A request of DefaultCost counts as one request.
+func (rl *RateLimiter) Check(clientID string, cost float64) Result {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
@@ -115,14 +193,16 @@ func (rl *RateLimiter) Check(clientID string) Result {
 	// Clamp interval to avoid division by zero
 	interval = math.Max(interval, 1.0e-10)
 
-	// Calculate exponential smoothing weight
+	// Calculate exponential smoothing weight, and 1-alpha with Expm1 as 1-Exp
+	// loses precision for short intervals and would count more than the cost
 	alpha := math.Exp(-interval)
+	beta := -math.Expm1(-interval)
 
 	// Calculate instantaneous rate (cost per period)
 	rInst := cost / interval
 
 	// Update average rate using exponential smoothing
-	rNow := (1-alpha)*rInst + alpha*client.rate
+	rNow := beta*rInst + alpha*client.rate
 
 	// Ensure rare requests are counted in full
 	rNow = math.Max(rNow, cost)
@@ -174,6 +254,16 @@ func (rl *RateLimiter) GetLastUpdate(clientID string) (time.Time, bool) {
 	return client.time, true
 }
 
+// Limit returns the rate limit threshold, in cost per period
+func (rl *RateLimiter) Limit() float64 {
+	return rl.limit
+}
+
+// Period returns the time period for rate calculation
+func (rl *RateLimiter) Period() time.Duration {
+	return rl.period
+}
+
 // RemoveClient removes a client from the rate limiter
 func (rl *RateLimiter) RemoveClient(clientID string) {
 	rl.mu.Lock()
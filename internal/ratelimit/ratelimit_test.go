@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckCost(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  float64
+		strict bool
+		costs  []float64
+		want   []bool
+	}{
+		{"default cost", 3, false, []float64{1, 1, 1, 1}, []bool{true, true, true, false}},
+		{"cost above one", 10, false, []float64{5, 5, 5}, []bool{true, true, false}},
+		{"mixed costs", 10, false, []float64{1, 9, 1}, []bool{true, true, false}},
+		// Denied requests are not counted unless strict
+		{"cost above limit", 10, false, []float64{11, 1, 11}, []bool{false, true, false}},
+		{"cost above limit strict", 10, true, []float64{11, 1}, []bool{false, false}},
+		{"cost equal to limit", 10, false, []float64{10, 1}, []bool{true, false}},
+	}
+	for _, tt := range tests {
+		rl := NewRateLimiter(tt.limit, time.Hour, tt.strict, nil)
+
+		for i, cost := range tt.costs {
+			before := time.Now()
+			result := rl.Check("client", cost)
+			if result.Allowed != tt.want[i] {
+				t.Errorf("%s: request %d of cost %g allowed = %v, want %v", tt.name, i, cost, result.Allowed, tt.want[i])
+			}
+			if !result.Allowed && !result.NextTime.After(before) {
+				t.Errorf("%s: request %d denied without a later time to retry", tt.name, i)
+			}
+		}
+
+		rl.Stop()
+	}
+}
+
+// TestCheckRate checks that the rate counts the cost of allowed requests
+func TestCheckRate(t *testing.T) {
+	rl := NewRateLimiter(100, time.Hour, false, nil)
+	defer rl.Stop()
+
+	rl.Check("client", 20)
+	rl.Check("client", 30)
+	rl.Check("client", 200) // Denied, not counted
+
+	rate, ok := rl.GetRate("client")
+	if !ok {
+		t.Fatal("client has no rate")
+	}
+	if rate < 49.9 || rate > 50 {
+		t.Errorf("rate = %g, want 50", rate)
+	}
+	if _, ok := rl.GetRate("other"); ok {
+		t.Error("unknown client has a rate")
+	}
+}
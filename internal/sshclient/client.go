@@ -0,0 +1,104 @@
+// Package sshclient runs keypub commands over SSH for the companion tools.
+package sshclient
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Config describes how to reach a keypub server
+type Config struct {
+	Address      string        // host:port of the keypub server
+	User         string        // SSH user name, ignored by keypub but required by the protocol
+	IdentityPath string        // Private key used to authenticate
+	HostKey      string        // Pinned server host key in authorized_keys format
+	Timeout      time.Duration // Dial and handshake timeout
+}
+
+// Client is a connection to a keypub server
+type Client struct {
+	conn *gossh.Client
+}
+
+// Dial connects to the server, refusing any host key other than the pinned one
+func Dial(cfg Config) (*Client, error) {
+	if cfg.HostKey == "" {
+		return nil, errors.New("host key must be pinned")
+	}
+	hostKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(cfg.HostKey))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse host key: %w", err)
+	}
+
+	keyBytes, err := os.ReadFile(cfg.IdentityPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load identity: %w", err)
+	}
+	signer, err := gossh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse identity: %w", err)
+	}
+
+	user := cfg.User
+	if user == "" {
+		user = "keypub"
+	}
+
+	conn, err := gossh.Dial("tcp", cfg.Address, &gossh.ClientConfig{
+		User:            user,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
+		HostKeyCallback: gossh.FixedHostKey(hostKey),
+		Timeout:         cfg.Timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %w", cfg.Address, err)
+	}
+
+	return &Client{conn: conn}, nil
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Run executes a single keypub command and returns its output.
+// Arguments are sent space separated, so they must not contain whitespace.
+func (c *Client) Run(args ...string) (string, error) {
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\r\n'\"\\") {
+			return "", fmt.Errorf("invalid argument: %q", arg)
+		}
+	}
+
+	session, err := c.conn.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("cannot open session: %w", err)
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	err = session.Run(strings.Join(args, " "))
+	output := strings.TrimSpace(stdout.String())
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", errors.New(msg)
+		}
+		return "", fmt.Errorf("command failed: %w", err)
+	}
+	// Older servers report errors on stdout with exit status 0
+	if strings.HasPrefix(output, "Error: ") {
+		return "", errors.New(output)
+	}
+
+	return output, nil
+}
@@ -0,0 +1,264 @@
+package translog
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Tree heads and proofs are exchanged as "name: value" lines, one field per
+// line. Hashes are hex encoded and path fields repeat once per hash. The JSON
+// encoding uses the same field names, with path as an array.
+
+// InclusionProof proves that an entry is part of the tree described by Head
+type InclusionProof struct {
+	Head      SignedTreeHead
+	LeafIndex uint64
+	LeafData  string
+	Path      [][]byte
+}
+
+// ConsistencyProof proves that the tree of OldSize leaves is a prefix of the
+// tree of NewSize leaves
+type ConsistencyProof struct {
+	OldSize uint64
+	NewSize uint64
+	OldRoot []byte
+	NewRoot []byte
+	Path    [][]byte
+}
+
+// Verify checks the proof against the tree head it was issued with
+func (p *InclusionProof) Verify() error {
+	return VerifyInclusion(p.LeafIndex, p.Head.Size, LeafHash([]byte(p.LeafData)), p.Path, p.Head.RootHash)
+}
+
+// Verify checks the proof against roots the caller already trusts
+func (p *ConsistencyProof) Verify(oldRoot, newRoot []byte) error {
+	return VerifyConsistency(p.OldSize, p.NewSize, oldRoot, newRoot, p.Path)
+}
+
+func (h *SignedTreeHead) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "tree_size: %d\n", h.Size)
+	fmt.Fprintf(&b, "root_hash: %x\n", h.RootHash)
+	fmt.Fprintf(&b, "timestamp: %d\n", h.Timestamp)
+	fmt.Fprintf(&b, "signature: %s", encodeSignature(h.Signature))
+	return b.String()
+}
+
+func (p *InclusionProof) String() string {
+	var b strings.Builder
+	b.WriteString(p.Head.String())
+	fmt.Fprintf(&b, "\nleaf_index: %d\n", p.LeafIndex)
+	fmt.Fprintf(&b, "leaf_data: %s", p.LeafData)
+	writePath(&b, p.Path)
+	return b.String()
+}
+
+func (p *ConsistencyProof) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "old_size: %d\n", p.OldSize)
+	fmt.Fprintf(&b, "new_size: %d\n", p.NewSize)
+	fmt.Fprintf(&b, "old_root: %x\n", p.OldRoot)
+	fmt.Fprintf(&b, "new_root: %x", p.NewRoot)
+	writePath(&b, p.Path)
+	return b.String()
+}
+
+func writePath(b *strings.Builder, path [][]byte) {
+	for _, h := range path {
+		fmt.Fprintf(b, "\npath: %x", h)
+	}
+}
+
+// headJSON is the JSON encoding of a signed tree head
+type headJSON struct {
+	TreeSize  uint64 `json:"tree_size"`
+	RootHash  string `json:"root_hash"`
+	Timestamp int64  `json:"timestamp"`
+	Signature string `json:"signature"`
+}
+
+func (h *SignedTreeHead) json() headJSON {
+	return headJSON{
+		TreeSize:  h.Size,
+		RootHash:  hex.EncodeToString(h.RootHash),
+		Timestamp: h.Timestamp,
+		Signature: encodeSignature(h.Signature),
+	}
+}
+
+func hexPath(path [][]byte) []string {
+	hashes := make([]string, len(path))
+	for i, h := range path {
+		hashes[i] = hex.EncodeToString(h)
+	}
+	return hashes
+}
+
+func (h *SignedTreeHead) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.json())
+}
+
+func (p *InclusionProof) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		headJSON
+		LeafIndex uint64   `json:"leaf_index"`
+		LeafData  string   `json:"leaf_data"`
+		Path      []string `json:"path"`
+	}{p.Head.json(), p.LeafIndex, p.LeafData, hexPath(p.Path)})
+}
+
+func (p *ConsistencyProof) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		OldSize uint64   `json:"old_size"`
+		NewSize uint64   `json:"new_size"`
+		OldRoot string   `json:"old_root"`
+		NewRoot string   `json:"new_root"`
+		Path    []string `json:"path"`
+	}{p.OldSize, p.NewSize, hex.EncodeToString(p.OldRoot), hex.EncodeToString(p.NewRoot), hexPath(p.Path)})
+}
+
+// ParseSignedTreeHead parses the output of SignedTreeHead.String
+func ParseSignedTreeHead(s string) (*SignedTreeHead, error) {
+	f, err := parseFields(s)
+	if err != nil {
+		return nil, err
+	}
+	return f.head()
+}
+
+// ParseInclusionProof parses the output of InclusionProof.String
+func ParseInclusionProof(s string) (*InclusionProof, error) {
+	f, err := parseFields(s)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := f.head()
+	if err != nil {
+		return nil, err
+	}
+	p := &InclusionProof{Head: *head}
+	if p.LeafIndex, err = f.uint("leaf_index"); err != nil {
+		return nil, err
+	}
+	if p.LeafData, err = f.single("leaf_data"); err != nil {
+		return nil, err
+	}
+	if p.Path, err = f.hashes("path"); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ParseConsistencyProof parses the output of ConsistencyProof.String
+func ParseConsistencyProof(s string) (*ConsistencyProof, error) {
+	f, err := parseFields(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ConsistencyProof{}
+	if p.OldSize, err = f.uint("old_size"); err != nil {
+		return nil, err
+	}
+	if p.NewSize, err = f.uint("new_size"); err != nil {
+		return nil, err
+	}
+	if p.OldRoot, err = f.hash("old_root"); err != nil {
+		return nil, err
+	}
+	if p.NewRoot, err = f.hash("new_root"); err != nil {
+		return nil, err
+	}
+	if p.Path, err = f.hashes("path"); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+type fields map[string][]string
+
+func parseFields(s string) (fields, error) {
+	f := fields{}
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		name, value, ok := strings.Cut(strings.TrimSpace(line), ": ")
+		if !ok {
+			return nil, fmt.Errorf("malformed line: %q", line)
+		}
+		f[name] = append(f[name], value)
+	}
+	return f, nil
+}
+
+func (f fields) single(name string) (string, error) {
+	values := f[name]
+	if len(values) != 1 {
+		return "", fmt.Errorf("expected exactly one %s field", name)
+	}
+	return values[0], nil
+}
+
+func (f fields) uint(name string) (uint64, error) {
+	value, err := f.single(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return n, nil
+}
+
+func (f fields) hash(name string) ([]byte, error) {
+	value, err := f.single(name)
+	if err != nil {
+		return nil, err
+	}
+	h, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return h, nil
+}
+
+func (f fields) hashes(name string) ([][]byte, error) {
+	var hashes [][]byte
+	for _, value := range f[name] {
+		h, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, nil
+}
+
+func (f fields) head() (*SignedTreeHead, error) {
+	h := &SignedTreeHead{}
+	var err error
+	if h.Size, err = f.uint("tree_size"); err != nil {
+		return nil, err
+	}
+	if h.RootHash, err = f.hash("root_hash"); err != nil {
+		return nil, err
+	}
+	timestamp, err := f.uint("timestamp")
+	if err != nil {
+		return nil, err
+	}
+	h.Timestamp = int64(timestamp)
+	signature, err := f.single("signature")
+	if err != nil {
+		return nil, err
+	}
+	if h.Signature, err = decodeSignature(signature); err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	return h, nil
+}
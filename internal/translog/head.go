@@ -0,0 +1,77 @@
+package translog
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// signatureContext separates tree head signatures from any other use of the host key
+const signatureContext = "keypub.sh tree head v1"
+
+// TreeHead is the state of the log at a given size
+type TreeHead struct {
+	Size      uint64
+	RootHash  []byte
+	Timestamp int64 // Unix time the head was signed
+}
+
+// SignedTreeHead is a tree head signed with the server host key
+type SignedTreeHead struct {
+	TreeHead
+	Signature *gossh.Signature
+}
+
+// signedData returns the bytes covered by the signature
+func (h TreeHead) signedData() []byte {
+	return []byte(fmt.Sprintf("%s\n%d\n%x\n%d\n", signatureContext, h.Size, h.RootHash, h.Timestamp))
+}
+
+// Sign signs the tree head with the given host key. RSA keys sign with
+// rsa-sha2-256 rather than the SHA-1 based ssh-rsa default.
+func (h TreeHead) Sign(signer gossh.Signer) (*SignedTreeHead, error) {
+	var sig *gossh.Signature
+	var err error
+	if algorithmSigner, ok := signer.(gossh.AlgorithmSigner); ok && signer.PublicKey().Type() == gossh.KeyAlgoRSA {
+		sig, err = algorithmSigner.SignWithAlgorithm(rand.Reader, h.signedData(), gossh.KeyAlgoRSASHA256)
+	} else {
+		sig, err = signer.Sign(rand.Reader, h.signedData())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign tree head: %w", err)
+	}
+	return &SignedTreeHead{TreeHead: h, Signature: sig}, nil
+}
+
+// Verify checks the signature against the server host key
+func (h *SignedTreeHead) Verify(key gossh.PublicKey) error {
+	if h.Signature == nil {
+		return errors.New("tree head is not signed")
+	}
+	if key.Type() == gossh.KeyAlgoRSA && h.Signature.Format == gossh.KeyAlgoRSA {
+		return errors.New("tree head signed with SHA-1")
+	}
+	if err := key.Verify(h.signedData(), h.Signature); err != nil {
+		return fmt.Errorf("invalid tree head signature: %w", err)
+	}
+	return nil
+}
+
+func encodeSignature(sig *gossh.Signature) string {
+	return base64.StdEncoding.EncodeToString(gossh.Marshal(sig))
+}
+
+func decodeSignature(s string) (*gossh.Signature, error) {
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	sig := &gossh.Signature{}
+	if err := gossh.Unmarshal(raw, sig); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
@@ -0,0 +1,415 @@
+package translog
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/bits"
+	"strings"
+	"time"
+
+	"keypub/internal/db/.gen/table"
+
+	"github.com/go-jet/jet/v2/qrm"
+	. "github.com/go-jet/jet/v2/sqlite"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Operations recorded in the log
+const (
+	OpConfirm    = "confirm"
+	OpUnregister = "unregister"
+	OpAllow      = "allow"
+	OpDeny       = "deny"
+)
+
+// Entry is a single registry mutation. Emails are only recorded as hashes,
+// so the log can be public without revealing who is registered; a user can
+// still find their own entries by hashing their email.
+type Entry struct {
+	Op          string `json:"op"`
+	Timestamp   int64  `json:"timestamp"`
+	EmailHash   string `json:"email_hash"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	PublicKey   string `json:"public_key,omitempty"`
+	GranteeHash string `json:"grantee_hash,omitempty"` // allow and deny only
+}
+
+// HashEmail returns the hex SHA256 of the email as recorded in entries
+func HashEmail(email string) string {
+	sum := sha256.Sum256([]byte(email))
+	return hex.EncodeToString(sum[:])
+}
+
+// Append adds the entry as the next leaf of the log and returns its index.
+// It must run in the same transaction as the mutation it records, which makes
+// the index taken from the last leaf safe to use.
+func Append(db qrm.DB, entry Entry) (uint64, error) {
+	if entry.Timestamp == 0 {
+		entry.Timestamp = time.Now().Unix()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode log entry: %w", err)
+	}
+
+	size, frontier, err := currentTree(db)
+	if err != nil {
+		return 0, err
+	}
+	leafHash := LeafHash(data)
+	frontier = extendFrontier(frontier, size, leafHash)
+
+	_, err = table.TransparencyLog.INSERT(
+		table.TransparencyLog.LeafIndex,
+		table.TransparencyLog.LeafData,
+		table.TransparencyLog.LeafHash,
+		table.TransparencyLog.Frontier,
+	).VALUES(
+		size,
+		string(data),
+		hex.EncodeToString(leafHash),
+		encodeFrontier(frontier),
+	).Exec(db)
+	if err != nil {
+		return 0, fmt.Errorf("failed to append log entry: %w", err)
+	}
+
+	return size, nil
+}
+
+// Size returns the number of leaves in the log
+func Size(db qrm.DB) (uint64, error) {
+	size, _, err := lastLeaf(db)
+	return size, err
+}
+
+// lastLeaf returns the size of the log, which is the index of its last leaf
+// plus one, and the frontier stored with that leaf, nil if there is none
+func lastLeaf(db qrm.DB) (uint64, *string, error) {
+	var rows []struct {
+		LeafIndex int64
+		Frontier  *string
+	}
+	err := SELECT(
+		table.TransparencyLog.LeafIndex.AS("leaf_index"),
+		table.TransparencyLog.Frontier.AS("frontier"),
+	).FROM(
+		table.TransparencyLog,
+	).ORDER_BY(
+		table.TransparencyLog.LeafIndex.DESC(),
+	).LIMIT(1).Query(db, &rows)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to query last log entry: %w", err)
+	}
+	if len(rows) == 0 {
+		return 0, nil, nil
+	}
+	return uint64(rows[0].LeafIndex) + 1, rows[0].Frontier, nil
+}
+
+// currentTree returns the size and the frontier of the tree. Leaves appended
+// before frontiers were stored have it computed from all leaf hashes.
+func currentTree(db qrm.DB) (uint64, [][]byte, error) {
+	size, encoded, err := lastLeaf(db)
+	if err != nil {
+		return 0, nil, err
+	}
+	if encoded == nil {
+		leaves, err := LeafHashes(db, size)
+		if err != nil {
+			return 0, nil, err
+		}
+		return size, frontierOf(leaves), nil
+	}
+
+	frontier, err := decodeFrontier(*encoded)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid frontier for leaf %d: %w", size-1, err)
+	}
+	return size, frontier, nil
+}
+
+// BackfillFrontiers stores the frontier of the leaves appended before
+// frontiers were stored, so heads and proofs never need to read every leaf
+func BackfillFrontiers(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	var missing []int64
+	err = SELECT(table.TransparencyLog.LeafIndex).
+		FROM(table.TransparencyLog).
+		WHERE(table.TransparencyLog.Frontier.IS_NULL()).
+		ORDER_BY(table.TransparencyLog.LeafIndex.ASC()).
+		Query(tx, &missing)
+	if err != nil {
+		return fmt.Errorf("failed to query log entries without frontier: %w", err)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	size := uint64(missing[len(missing)-1]) + 1
+	leaves, err := LeafHashes(tx, size)
+	if err != nil {
+		return err
+	}
+	var frontier [][]byte
+	next := 0
+	for i, leaf := range leaves {
+		frontier = extendFrontier(frontier, uint64(i), leaf)
+		if int64(i) != missing[next] {
+			continue
+		}
+		_, err = table.TransparencyLog.UPDATE(table.TransparencyLog.Frontier).
+			SET(encodeFrontier(frontier)).
+			WHERE(table.TransparencyLog.LeafIndex.EQ(Int(int64(i)))).
+			Exec(tx)
+		if err != nil {
+			return fmt.Errorf("failed to store frontier of leaf %d: %w", i, err)
+		}
+		next++
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	log.Printf("Stored the frontier of %d transparency log entries", len(missing))
+	return nil
+}
+
+func encodeFrontier(frontier [][]byte) string {
+	encoded := make([]string, len(frontier))
+	for i, hash := range frontier {
+		encoded[i] = hex.EncodeToString(hash)
+	}
+	return strings.Join(encoded, ",")
+}
+
+func decodeFrontier(s string) ([][]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	frontier := make([][]byte, len(parts))
+	for i, part := range parts {
+		hash, err := hex.DecodeString(part)
+		if err != nil {
+			return nil, err
+		}
+		frontier[i] = hash
+	}
+	return frontier, nil
+}
+
+// LeafHashes returns the hashes of the first size leaves, in order
+func LeafHashes(db qrm.DB, size uint64) ([][]byte, error) {
+	return leafHashRange(db, 0, size)
+}
+
+// leafHashRange returns the hashes of the leaves from start to end, in order
+func leafHashRange(db qrm.DB, start, end uint64) ([][]byte, error) {
+	var hexHashes []string
+	err := SELECT(table.TransparencyLog.LeafHash).
+		FROM(table.TransparencyLog).
+		WHERE(
+			table.TransparencyLog.LeafIndex.GT_EQ(Int(int64(start))).
+				AND(table.TransparencyLog.LeafIndex.LT(Int(int64(end)))),
+		).
+		ORDER_BY(table.TransparencyLog.LeafIndex.ASC()).
+		Query(db, &hexHashes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query leaf hashes: %w", err)
+	}
+	if uint64(len(hexHashes)) != end-start {
+		return nil, fmt.Errorf("log has %d leaves from %d to %d, expected %d", len(hexHashes), start, end, end-start)
+	}
+
+	hashes := make([][]byte, len(hexHashes))
+	for i, h := range hexHashes {
+		hashes[i], err = hex.DecodeString(h)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash for leaf %d: %w", start+uint64(i), err)
+		}
+	}
+	return hashes, nil
+}
+
+// dbSubtree computes the subtree hashes of proofs from the stored frontiers,
+// reading a couple of rows per perfect subtree instead of every leaf
+func dbSubtree(db qrm.DB) subtreeFunc {
+	return func(start, end uint64) ([]byte, error) {
+		// A subtree is made of perfect subtrees, largest first, like a tree
+		// is made of the subtrees of its frontier
+		var pieces [][]byte
+		for start < end {
+			size := uint64(1) << (bits.Len64(end-start) - 1)
+			if start > 0 {
+				size = min(size, start&-start)
+			}
+			hash, err := perfectSubtree(db, start, size)
+			if err != nil {
+				return nil, err
+			}
+			pieces = append(pieces, hash)
+			start += size
+		}
+		return frontierRoot(pieces), nil
+	}
+}
+
+// perfectSubtree returns the hash of the perfect subtree of size leaves, a
+// power of two, from start, a multiple of size. The frontier of the tree
+// ending one leaf before the subtree does holds the subtrees of size/2, size/4
+// and so on down to one leaf that the subtree is made of, along with its last
+// leaf. Leaves appended before frontiers were stored are read instead.
+func perfectSubtree(db qrm.DB, start, size uint64) ([]byte, error) {
+	last := start + size - 1
+	if size == 1 {
+		leaves, err := leafHashRange(db, last, last+1)
+		if err != nil {
+			return nil, err
+		}
+		return leaves[0], nil
+	}
+
+	var rows []struct {
+		LeafIndex int64
+		LeafHash  string
+		Frontier  *string
+	}
+	err := SELECT(
+		table.TransparencyLog.LeafIndex.AS("leaf_index"),
+		table.TransparencyLog.LeafHash.AS("leaf_hash"),
+		table.TransparencyLog.Frontier.AS("frontier"),
+	).FROM(
+		table.TransparencyLog,
+	).WHERE(
+		table.TransparencyLog.LeafIndex.IN(Int(int64(last-1)), Int(int64(last))),
+	).ORDER_BY(
+		table.TransparencyLog.LeafIndex.ASC(),
+	).Query(db, &rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query log entries: %w", err)
+	}
+	if len(rows) != 2 {
+		return nil, fmt.Errorf("log has %d of leaves %d and %d, expected 2", len(rows), last-1, last)
+	}
+	if rows[0].Frontier == nil {
+		leaves, err := leafHashRange(db, start, start+size)
+		if err != nil {
+			return nil, err
+		}
+		return RootHash(leaves), nil
+	}
+
+	frontier, err := decodeFrontier(*rows[0].Frontier)
+	if err != nil {
+		return nil, fmt.Errorf("invalid frontier for leaf %d: %w", last-1, err)
+	}
+	levels := bits.Len64(size) - 1
+	if len(frontier) < levels {
+		return nil, fmt.Errorf("frontier for leaf %d has %d subtrees, expected at least %d", last-1, len(frontier), levels)
+	}
+	leaf, err := hex.DecodeString(rows[1].LeafHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hash for leaf %d: %w", last, err)
+	}
+	return frontierRoot(append(frontier[len(frontier)-levels:], leaf)), nil
+}
+
+// LeafData returns the encoded entry at index
+func LeafData(db qrm.DB, index uint64) (string, error) {
+	var data []string
+	err := SELECT(table.TransparencyLog.LeafData).
+		FROM(table.TransparencyLog).
+		WHERE(table.TransparencyLog.LeafIndex.EQ(Int(int64(index)))).
+		Query(db, &data)
+	if err != nil {
+		return "", fmt.Errorf("failed to query log entry: %w", err)
+	}
+	if len(data) == 0 {
+		return "", ErrInvalidIndex
+	}
+	return data[0], nil
+}
+
+// SignedHead returns the current tree head signed with the host key
+func SignedHead(db qrm.DB, signer gossh.Signer) (*SignedTreeHead, error) {
+	size, frontier, err := currentTree(db)
+	if err != nil {
+		return nil, err
+	}
+	return TreeHead{
+		Size:      size,
+		RootHash:  frontierRoot(frontier),
+		Timestamp: time.Now().Unix(),
+	}.Sign(signer)
+}
+
+// ProveInclusion returns the proof for the entry at index in the current tree
+func ProveInclusion(db qrm.DB, signer gossh.Signer, index uint64) (*InclusionProof, error) {
+	head, err := SignedHead(db, signer)
+	if err != nil {
+		return nil, err
+	}
+	if index >= head.Size {
+		return nil, ErrInvalidIndex
+	}
+	path, err := inclusionPath(index, 0, head.Size, dbSubtree(db))
+	if err != nil {
+		return nil, err
+	}
+	data, err := LeafData(db, index)
+	if err != nil {
+		return nil, err
+	}
+	return &InclusionProof{
+		Head:      *head,
+		LeafIndex: index,
+		LeafData:  data,
+		Path:      path,
+	}, nil
+}
+
+// ProveConsistency returns the proof that the tree of oldSize leaves is a
+// prefix of the tree of newSize leaves
+func ProveConsistency(db qrm.DB, oldSize, newSize uint64) (*ConsistencyProof, error) {
+	size, err := Size(db)
+	if err != nil {
+		return nil, err
+	}
+	if oldSize > newSize || newSize > size {
+		return nil, ErrInvalidIndex
+	}
+	subtree := dbSubtree(db)
+	path, err := consistencyPath(oldSize, newSize, subtree)
+	if err != nil {
+		return nil, err
+	}
+	oldRoot, err := subtree(0, oldSize)
+	if err != nil {
+		return nil, err
+	}
+	newRoot, err := subtree(0, newSize)
+	if err != nil {
+		return nil, err
+	}
+	return &ConsistencyProof{
+		OldSize: oldSize,
+		NewSize: newSize,
+		OldRoot: oldRoot,
+		NewRoot: newRoot,
+		Path:    path,
+	}, nil
+}
@@ -0,0 +1,277 @@
+package translog
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	db_utils "keypub/internal/db"
+
+	_ "github.com/mattn/go-sqlite3"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1) // Every connection would get its own database
+	t.Cleanup(func() { db.Close() })
+
+	if err := db_utils.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func testSigner(t *testing.T) gossh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func appendTestEntry(t *testing.T, db *sql.DB, i int) uint64 {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	index, err := Append(tx, Entry{Op: OpConfirm, Timestamp: int64(i), EmailHash: HashEmail(fmt.Sprintf("%d@example.org", i))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return index
+}
+
+// checkHead compares the signed head with the root computed from all leaves
+func checkHead(t *testing.T, db *sql.DB, signer gossh.Signer, size uint64) {
+	t.Helper()
+	head, err := SignedHead(db, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Size != size {
+		t.Fatalf("head size = %d, want %d", head.Size, size)
+	}
+	leaves, err := LeafHashes(db, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(head.RootHash, RootHash(leaves)) {
+		t.Fatalf("head root of size %d = %x, want %x", size, head.RootHash, RootHash(leaves))
+	}
+	if err := head.Verify(signer.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppendAndSignedHead(t *testing.T) {
+	db := openTestDB(t)
+	signer := testSigner(t)
+
+	checkHead(t, db, signer, 0)
+	for i := 0; i < 13; i++ {
+		if index := appendTestEntry(t, db, i); index != uint64(i) {
+			t.Fatalf("Append returned index %d, want %d", index, i)
+		}
+		checkHead(t, db, signer, uint64(i+1))
+	}
+}
+
+// TestAppendWithoutFrontier covers leaves appended before frontiers were
+// stored, which have theirs computed from the leaf hashes
+func TestAppendWithoutFrontier(t *testing.T) {
+	db := openTestDB(t)
+	signer := testSigner(t)
+
+	for i := 0; i < 6; i++ {
+		appendTestEntry(t, db, i)
+	}
+	if _, err := db.Exec("UPDATE transparency_log SET frontier = NULL"); err != nil {
+		t.Fatal(err)
+	}
+	checkHead(t, db, signer, 6)
+
+	for i := 6; i < 9; i++ {
+		appendTestEntry(t, db, i)
+		checkHead(t, db, signer, uint64(i+1))
+	}
+}
+
+// TestAppendAfterGap takes the next index from the last leaf rather than
+// counting leaves, so a missing row cannot make two leaves share an index
+func TestAppendAfterGap(t *testing.T) {
+	db := openTestDB(t)
+
+	for i := 0; i < 3; i++ {
+		appendTestEntry(t, db, i)
+	}
+	if _, err := db.Exec("DELETE FROM transparency_log WHERE leaf_index = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if index := appendTestEntry(t, db, 3); index != 3 {
+		t.Fatalf("Append returned index %d, want 3", index)
+	}
+}
+
+func TestProveInclusionAndConsistency(t *testing.T) {
+	db := openTestDB(t)
+	signer := testSigner(t)
+
+	for i := 0; i < 7; i++ {
+		appendTestEntry(t, db, i)
+	}
+
+	for index := uint64(0); index < 7; index++ {
+		proof, err := ProveInclusion(db, signer, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := proof.Verify(); err != nil {
+			t.Errorf("inclusion proof of %d: %v", index, err)
+		}
+	}
+	if _, err := ProveInclusion(db, signer, 7); err != ErrInvalidIndex {
+		t.Errorf("ProveInclusion past the end: err = %v, want ErrInvalidIndex", err)
+	}
+
+	proof, err := ProveConsistency(db, 3, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := SignedHead(db, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(proof.NewRoot, head.RootHash) {
+		t.Errorf("consistency proof root = %x, head root = %x", proof.NewRoot, head.RootHash)
+	}
+	if err := proof.Verify(proof.OldRoot, head.RootHash); err != nil {
+		t.Errorf("consistency proof 3 -> 7: %v", err)
+	}
+}
+
+// checkProofs compares the proofs computed from the database with the ones
+// computed from all leaves, for every index and pair of sizes
+func checkProofs(t *testing.T, db *sql.DB, signer gossh.Signer, size uint64) {
+	t.Helper()
+	leaves, err := LeafHashes(db, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for index := uint64(0); index < size; index++ {
+		proof, err := ProveInclusion(db, signer, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := InclusionPath(index, leaves)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalPaths(proof.Path, want) {
+			t.Fatalf("inclusion proof of %d in %d = %x, want %x", index, size, proof.Path, want)
+		}
+	}
+
+	for newSize := uint64(0); newSize <= size; newSize++ {
+		for oldSize := uint64(0); oldSize <= newSize; oldSize++ {
+			proof, err := ProveConsistency(db, oldSize, newSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := ConsistencyPath(oldSize, leaves[:newSize])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalPaths(proof.Path, want) {
+				t.Fatalf("consistency proof %d -> %d = %x, want %x", oldSize, newSize, proof.Path, want)
+			}
+			if !bytes.Equal(proof.OldRoot, RootHash(leaves[:oldSize])) || !bytes.Equal(proof.NewRoot, RootHash(leaves[:newSize])) {
+				t.Fatalf("consistency proof %d -> %d has wrong roots", oldSize, newSize)
+			}
+		}
+	}
+}
+
+func TestProofsFromFrontiers(t *testing.T) {
+	db := openTestDB(t)
+	signer := testSigner(t)
+
+	for i := 0; i < 21; i++ {
+		appendTestEntry(t, db, i)
+		checkProofs(t, db, signer, uint64(i+1))
+	}
+}
+
+// TestBackfillFrontiers covers leaves appended before frontiers were stored,
+// whose proofs are computed from the leaves until the frontiers are backfilled
+func TestBackfillFrontiers(t *testing.T) {
+	db := openTestDB(t)
+	signer := testSigner(t)
+
+	for i := 0; i < 21; i++ {
+		appendTestEntry(t, db, i)
+	}
+	stored := readFrontiers(t, db)
+	if _, err := db.Exec("UPDATE transparency_log SET frontier = NULL WHERE leaf_index < 13"); err != nil {
+		t.Fatal(err)
+	}
+	checkProofs(t, db, signer, 21)
+
+	if err := BackfillFrontiers(db); err != nil {
+		t.Fatal(err)
+	}
+	if backfilled := readFrontiers(t, db); !equalStrings(backfilled, stored) {
+		t.Fatalf("backfilled frontiers = %q, want %q", backfilled, stored)
+	}
+	checkProofs(t, db, signer, 21)
+}
+
+func readFrontiers(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT COALESCE(frontier, '') FROM transparency_log ORDER BY leaf_index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var frontiers []string
+	for rows.Next() {
+		var frontier string
+		if err := rows.Scan(&frontier); err != nil {
+			t.Fatal(err)
+		}
+		frontiers = append(frontiers, frontier)
+	}
+	return frontiers
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,267 @@
+// Package translog implements an append-only Merkle tree log of registry
+// mutations, following the tree hashing and proofs of RFC 9162 (Certificate
+// Transparency 2.0), section 2.1.
+package translog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+)
+
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+var (
+	ErrInvalidIndex = errors.New("index out of range")
+	ErrInvalidProof = errors.New("proof does not verify")
+)
+
+// LeafHash returns the hash of a leaf with the given data
+func LeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// nodeHash returns the hash of an interior node with the given children
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// splitPoint returns the largest power of two smaller than n (n > 1)
+func splitPoint(n uint64) uint64 {
+	return 1 << (bits.Len64(n-1) - 1)
+}
+
+// RootHash returns the Merkle tree hash of the given leaf hashes
+func RootHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	case 1:
+		return leaves[0]
+	}
+	k := splitPoint(uint64(len(leaves)))
+	return nodeHash(RootHash(leaves[:k]), RootHash(leaves[k:]))
+}
+
+// extendFrontier returns the frontier of the tree of size+1 leaves from the
+// frontier of the tree of size leaves. The frontier of a tree is the roots
+// of the perfect subtrees it is made of, largest first, one per bit of size.
+func extendFrontier(frontier [][]byte, size uint64, leaf []byte) [][]byte {
+	extended := append(frontier[:len(frontier):len(frontier)], leaf)
+	for ; size&1 == 1; size >>= 1 {
+		n := len(extended)
+		extended = append(extended[:n-2], nodeHash(extended[n-2], extended[n-1]))
+	}
+	return extended
+}
+
+// frontierOf returns the frontier of the tree made of the given leaf hashes
+func frontierOf(leaves [][]byte) [][]byte {
+	var frontier [][]byte
+	for i, leaf := range leaves {
+		frontier = extendFrontier(frontier, uint64(i), leaf)
+	}
+	return frontier
+}
+
+// frontierRoot returns the Merkle tree hash of the tree with the frontier
+func frontierRoot(frontier [][]byte) []byte {
+	if len(frontier) == 0 {
+		return RootHash(nil)
+	}
+	root := frontier[len(frontier)-1]
+	for i := len(frontier) - 2; i >= 0; i-- {
+		root = nodeHash(frontier[i], root)
+	}
+	return root
+}
+
+// subtreeFunc returns the Merkle tree hash of the leaves from start to end,
+// which must be a node of the tree the proof is for
+type subtreeFunc func(start, end uint64) ([]byte, error)
+
+// leavesSubtree computes subtree hashes from all the leaf hashes
+func leavesSubtree(leaves [][]byte) subtreeFunc {
+	return func(start, end uint64) ([]byte, error) {
+		return RootHash(leaves[start:end]), nil
+	}
+}
+
+// InclusionPath returns the audit path for the leaf at index in the tree
+// made of the given leaf hashes
+func InclusionPath(index uint64, leaves [][]byte) ([][]byte, error) {
+	if index >= uint64(len(leaves)) {
+		return nil, ErrInvalidIndex
+	}
+	return inclusionPath(index, 0, uint64(len(leaves)), leavesSubtree(leaves))
+}
+
+// inclusionPath returns the audit path for the leaf at index in the subtree
+// of the leaves from start to end
+func inclusionPath(index, start, end uint64, subtree subtreeFunc) ([][]byte, error) {
+	if end-start <= 1 {
+		return nil, nil
+	}
+	k := start + splitPoint(end-start)
+	inner, sibling := [2]uint64{start, k}, [2]uint64{k, end}
+	if index >= k {
+		inner, sibling = sibling, inner
+	}
+
+	path, err := inclusionPath(index, inner[0], inner[1], subtree)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := subtree(sibling[0], sibling[1])
+	if err != nil {
+		return nil, err
+	}
+	return append(path, hash), nil
+}
+
+// ConsistencyPath returns the proof that the tree of the first oldSize
+// leaves is a prefix of the tree made of all the given leaf hashes
+func ConsistencyPath(oldSize uint64, leaves [][]byte) ([][]byte, error) {
+	return consistencyPath(oldSize, uint64(len(leaves)), leavesSubtree(leaves))
+}
+
+func consistencyPath(oldSize, newSize uint64, subtree subtreeFunc) ([][]byte, error) {
+	if oldSize > newSize {
+		return nil, ErrInvalidIndex
+	}
+	if oldSize == 0 || oldSize == newSize {
+		return nil, nil
+	}
+	return subproof(oldSize, 0, newSize, true, subtree)
+}
+
+// subproof is SUBPROOF of RFC 9162 section 2.1.4.1 for the subtree of the
+// leaves from start to end, with m counted from the first leaf of the tree
+func subproof(m, start, end uint64, complete bool, subtree subtreeFunc) ([][]byte, error) {
+	if m == end {
+		if complete {
+			return nil, nil
+		}
+		root, err := subtree(start, end)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{root}, nil
+	}
+	k := start + splitPoint(end-start)
+	inner, sibling := [2]uint64{start, k}, [2]uint64{k, end}
+	if m > k {
+		inner, sibling, complete = sibling, inner, false
+	}
+
+	path, err := subproof(m, inner[0], inner[1], complete, subtree)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := subtree(sibling[0], sibling[1])
+	if err != nil {
+		return nil, err
+	}
+	return append(path, hash), nil
+}
+
+// VerifyInclusion checks that leafHash is at index in the tree of the given
+// size and root hash
+func VerifyInclusion(index, size uint64, leafHash []byte, path [][]byte, root []byte) error {
+	if index >= size {
+		return ErrInvalidIndex
+	}
+
+	fn, sn := index, size-1
+	r := leafHash
+	for _, p := range path {
+		if sn == 0 {
+			return ErrInvalidProof
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 || !bytes.Equal(r, root) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// VerifyConsistency checks that the tree of oldSize leaves with root oldRoot
+// is a prefix of the tree of newSize leaves with root newRoot
+func VerifyConsistency(oldSize, newSize uint64, oldRoot, newRoot []byte, path [][]byte) error {
+	switch {
+	case oldSize > newSize:
+		return ErrInvalidIndex
+	case oldSize == newSize:
+		if len(path) != 0 || !bytes.Equal(oldRoot, newRoot) {
+			return ErrInvalidProof
+		}
+		return nil
+	case oldSize == 0:
+		// The empty tree is a prefix of every tree
+		if len(path) != 0 {
+			return ErrInvalidProof
+		}
+		return nil
+	case len(path) == 0:
+		return ErrInvalidProof
+	}
+
+	// A complete old tree is its own first subtree, so the proof omits it
+	if oldSize&(oldSize-1) == 0 {
+		path = append([][]byte{oldRoot}, path...)
+	}
+
+	fn, sn := oldSize-1, newSize-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	fr, sr := path[0], path[0]
+	for _, c := range path[1:] {
+		if sn == 0 {
+			return ErrInvalidProof
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = nodeHash(c, fr)
+			sr = nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 || !bytes.Equal(fr, oldRoot) || !bytes.Equal(sr, newRoot) {
+		return ErrInvalidProof
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package translog
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// testLeaves are the leaf inputs of the reference Merkle tree used by the
+// Certificate Transparency test vectors (RFC 6962, hashing unchanged in RFC 9162)
+var testLeaves = []string{
+	"",
+	"00",
+	"10",
+	"2021",
+	"3031",
+	"40414243",
+	"5051525354555657",
+	"606162636465666768696a6b6c6d6e6f",
+}
+
+func testLeafHashes(t *testing.T, n int) [][]byte {
+	t.Helper()
+	hashes := make([][]byte, n)
+	for i := range hashes {
+		data, err := hex.DecodeString(testLeaves[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes[i] = LeafHash(data)
+	}
+	return hashes
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func decodeTestPath(t *testing.T, path ...string) [][]byte {
+	t.Helper()
+	hashes := make([][]byte, len(path))
+	for i, p := range path {
+		hashes[i] = mustHex(t, p)
+	}
+	return hashes
+}
+
+func equalPaths(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRootHash(t *testing.T) {
+	tests := []struct {
+		size int
+		root string
+	}{
+		{0, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{1, "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d"},
+		{2, "fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125"},
+		{3, "aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77"},
+		{4, "d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7"},
+		{5, "4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4"},
+		{6, "76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef"},
+		{7, "ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c"},
+		{8, "5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328"},
+	}
+	for _, tt := range tests {
+		leaves := testLeafHashes(t, tt.size)
+		want := mustHex(t, tt.root)
+		if got := RootHash(leaves); !bytes.Equal(got, want) {
+			t.Errorf("RootHash(%d leaves) = %x, want %s", tt.size, got, tt.root)
+		}
+		if got := frontierRoot(frontierOf(leaves)); !bytes.Equal(got, want) {
+			t.Errorf("frontierRoot(%d leaves) = %x, want %s", tt.size, got, tt.root)
+		}
+	}
+}
+
+func TestInclusionPath(t *testing.T) {
+	tests := []struct {
+		index, size uint64
+		path        []string
+	}{
+		{0, 1, nil},
+		{0, 8, []string{
+			"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+		}},
+		{5, 8, []string{
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+			"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		}},
+		{2, 3, []string{
+			"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+		}},
+		{1, 5, []string{
+			"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		}},
+	}
+	for _, tt := range tests {
+		leaves := testLeafHashes(t, int(tt.size))
+		path, err := InclusionPath(tt.index, leaves)
+		if err != nil {
+			t.Fatalf("InclusionPath(%d, %d leaves): %v", tt.index, tt.size, err)
+		}
+		if want := decodeTestPath(t, tt.path...); !equalPaths(path, want) {
+			t.Errorf("InclusionPath(%d, %d leaves) = %x, want %x", tt.index, tt.size, path, want)
+		}
+		if err := VerifyInclusion(tt.index, tt.size, leaves[tt.index], path, RootHash(leaves)); err != nil {
+			t.Errorf("VerifyInclusion(%d, %d): %v", tt.index, tt.size, err)
+		}
+	}
+
+	if _, err := InclusionPath(8, testLeafHashes(t, 8)); err != ErrInvalidIndex {
+		t.Errorf("InclusionPath past the end: err = %v, want ErrInvalidIndex", err)
+	}
+}
+
+func TestConsistencyPath(t *testing.T) {
+	tests := []struct {
+		oldSize, newSize uint64
+		path             []string
+	}{
+		{1, 1, nil},
+		{1, 8, []string{
+			"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+		}},
+		{6, 8, []string{
+			"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+			"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		}},
+		{2, 5, []string{
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		}},
+	}
+	for _, tt := range tests {
+		leaves := testLeafHashes(t, int(tt.newSize))
+		path, err := ConsistencyPath(tt.oldSize, leaves)
+		if err != nil {
+			t.Fatalf("ConsistencyPath(%d, %d leaves): %v", tt.oldSize, tt.newSize, err)
+		}
+		if want := decodeTestPath(t, tt.path...); !equalPaths(path, want) {
+			t.Errorf("ConsistencyPath(%d, %d leaves) = %x, want %x", tt.oldSize, tt.newSize, path, want)
+		}
+		oldRoot, newRoot := RootHash(leaves[:tt.oldSize]), RootHash(leaves)
+		if err := VerifyConsistency(tt.oldSize, tt.newSize, oldRoot, newRoot, path); err != nil {
+			t.Errorf("VerifyConsistency(%d, %d): %v", tt.oldSize, tt.newSize, err)
+		}
+	}
+}
+
+// TestProofsAllSizes checks every proof of trees up to 40 leaves against
+// the verifiers, and that altered proofs are rejected
+func TestProofsAllSizes(t *testing.T) {
+	var leaves [][]byte
+	for n := uint64(0); n <= 40; n++ {
+		root := RootHash(leaves)
+		if got := frontierRoot(frontierOf(leaves)); !bytes.Equal(got, root) {
+			t.Fatalf("frontier root of %d leaves = %x, want %x", n, got, root)
+		}
+
+		for i := uint64(0); i < n; i++ {
+			path, err := InclusionPath(i, leaves)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyInclusion(i, n, leaves[i], path, root); err != nil {
+				t.Fatalf("inclusion of %d in %d: %v", i, n, err)
+			}
+			if err := VerifyInclusion(i, n, LeafHash([]byte("other")), path, root); err != ErrInvalidProof {
+				t.Fatalf("inclusion of other leaf at %d in %d: err = %v", i, n, err)
+			}
+		}
+
+		for m := uint64(0); m <= n; m++ {
+			path, err := ConsistencyPath(m, leaves)
+			if err != nil {
+				t.Fatal(err)
+			}
+			oldRoot := RootHash(leaves[:m])
+			if err := VerifyConsistency(m, n, oldRoot, root, path); err != nil {
+				t.Fatalf("consistency %d -> %d: %v", m, n, err)
+			}
+			if m > 0 && m < n {
+				if err := VerifyConsistency(m, n, LeafHash([]byte("other")), root, path); err != ErrInvalidProof {
+					t.Fatalf("consistency %d -> %d with wrong old root: err = %v", m, n, err)
+				}
+			}
+		}
+
+		leaves = append(leaves, LeafHash([]byte{byte(n)}))
+	}
+}
+
+func TestExtendFrontier(t *testing.T) {
+	var frontier [][]byte
+	leaves := testLeafHashes(t, len(testLeaves))
+	for i, leaf := range leaves {
+		previous := frontier
+		frontier = extendFrontier(frontier, uint64(i), leaf)
+		if !equalPaths(frontier, frontierOf(leaves[:i+1])) {
+			t.Fatalf("frontier of %d leaves differs from frontierOf", i+1)
+		}
+		// The frontier of a previous size must not be modified
+		if !equalPaths(previous, frontierOf(leaves[:i])) {
+			t.Fatalf("extending the frontier of %d leaves modified it", i)
+		}
+	}
+
+	// One subtree root per bit of the size
+	if len(frontier) != 1 {
+		t.Errorf("frontier of 8 leaves has %d roots, want 1", len(frontier))
+	}
+	if got := frontierOf(leaves[:7]); len(got) != 3 {
+		t.Errorf("frontier of 7 leaves has %d roots, want 3", len(got))
+	}
+}
+
+func TestEncodeFrontier(t *testing.T) {
+	for n := 0; n <= len(testLeaves); n++ {
+		frontier := frontierOf(testLeafHashes(t, n))
+		decoded, err := decodeFrontier(encodeFrontier(frontier))
+		if err != nil {
+			t.Fatalf("decodeFrontier(%d leaves): %v", n, err)
+		}
+		if !equalPaths(decoded, frontier) {
+			t.Errorf("frontier of %d leaves does not round trip", n)
+		}
+	}
+}